@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"strings"
 
 	"github.com/radu-matei/cnab-go/pkg/bundle"
@@ -13,6 +14,10 @@ import (
 	"github.com/radu-matei/cnab-go/pkg/driver"
 )
 
+// CredentialFileMode is the mode of the files holding credentials in the invocation image, which
+// only their owner can read
+const CredentialFileMode os.FileMode = 0600
+
 // notStateless is there just to make callers of opFromClaims more readable
 const notStateless = false
 
@@ -43,10 +48,18 @@ func selectInvocationImage(d driver.Driver, c *claim.Claim) (bundle.InvocationIm
 	return bundle.InvocationImage{}, errors.New("driver is not compatible with any of the invocation images in the bundle")
 }
 
-func getImageMap(b *bundle.Bundle) ([]byte, error) {
-	imgs := b.Images
-	if imgs == nil {
-		imgs = make(map[string]bundle.Image)
+// getImageMap returns the image map injected into the invocation image, where images that were
+// relocated refer to their relocated reference.
+func getImageMap(b *bundle.Bundle, relocation bundle.ImageRelocationMap) ([]byte, error) {
+	if err := relocation.Validate(); err != nil {
+		return nil, err
+	}
+	imgs := make(map[string]bundle.Image, len(b.Images))
+	for name, img := range b.Images {
+		if relocated, ok := relocation[img.Image]; ok {
+			img.Image = relocated
+		}
+		imgs[name] = img
 	}
 	return json.Marshal(imgs)
 }
@@ -63,11 +76,38 @@ func appliesToAction(action string, parameter bundle.ParameterDefinition) bool {
 	return false
 }
 
+// fileSources records the input, such as a credential or a parameter, each file injected into
+// the invocation image comes from.
+type fileSources map[string]string
+
+// add records the source of a file, failing when another input is already injected at its path,
+// as one would silently overwrite the other.
+func (s fileSources) add(path, source string) error {
+	if other, ok := s[path]; ok {
+		return fmt.Errorf("%s and %s are both injected at %s", other, source, path)
+	}
+	s[path] = source
+	return nil
+}
+
 func opFromClaim(action string, stateless bool, c *claim.Claim, ii bundle.InvocationImage, creds credentials.Set, w io.Writer) (*driver.Operation, error) {
 	env, files, err := creds.Expand(c.Bundle, stateless)
 	if err != nil {
 		return nil, err
 	}
+	modes := make(map[string]os.FileMode, len(files))
+	for path := range files {
+		modes[path] = CredentialFileMode
+	}
+	sources := fileSources{}
+	for _, name := range bundle.CredentialNames(c.Bundle.Credentials) {
+		if _, ok := creds[name]; !ok || c.Bundle.Credentials[name].Path == "" {
+			continue
+		}
+		if err := sources.add(c.Bundle.Credentials[name].Path, fmt.Sprintf("credential %q", name)); err != nil {
+			return nil, err
+		}
+	}
 
 	// Quick verification that no params were passed that are not actual legit params.
 	for key := range c.Parameters {
@@ -76,7 +116,8 @@ func opFromClaim(action string, stateless bool, c *claim.Claim, ii bundle.Invoca
 		}
 	}
 
-	for k, param := range c.Bundle.Parameters {
+	for _, k := range bundle.ParameterNames(c.Bundle.Parameters) {
+		param := c.Bundle.Parameters[k]
 		rawval, ok := c.Parameters[k]
 		if !ok {
 			if param.Required && appliesToAction(action, param) {
@@ -91,6 +132,9 @@ func opFromClaim(action string, stateless bool, c *claim.Claim, ii bundle.Invoca
 			continue
 		}
 		if param.Destination.Path != "" {
+			if err := sources.add(param.Destination.Path, fmt.Sprintf("parameter %q", k)); err != nil {
+				return nil, err
+			}
 			files[param.Destination.Path] = value
 		}
 		if param.Destination.EnvironmentVariable != "" {
@@ -98,16 +142,22 @@ func opFromClaim(action string, stateless bool, c *claim.Claim, ii bundle.Invoca
 		}
 	}
 
-	imgMap, err := getImageMap(c.Bundle)
+	imgMap, err := getImageMap(c.Bundle, c.RelocationMap)
 	if err != nil {
 		return nil, fmt.Errorf("unable to generate image map: %s", err)
 	}
+	if err := sources.add("/cnab/app/image-map.json", "the image map"); err != nil {
+		return nil, err
+	}
 	files["/cnab/app/image-map.json"] = string(imgMap)
 
 	env["CNAB_INSTALLATION_NAME"] = c.Name
 	env["CNAB_ACTION"] = action
 	env["CNAB_BUNDLE_NAME"] = c.Bundle.Name
 	env["CNAB_BUNDLE_VERSION"] = c.Bundle.Version
+	env["CNAB_REVISION"] = c.Revision
+
+	modifiers, _ := driver.ActionModifiersFor(c.Bundle, action)
 
 	return &driver.Operation{
 		Action:       action,
@@ -118,6 +168,9 @@ func opFromClaim(action string, stateless bool, c *claim.Claim, ii bundle.Invoca
 		Revision:     c.Revision,
 		Environment:  env,
 		Files:        files,
+		FileModes:    modes,
+		Bundle:       c.Bundle,
+		Modifiers:    modifiers,
 		Out:          w,
 	}, nil
 }
@@ -28,8 +28,8 @@ var mockSet = credentials.Set{
 func (d *mockFailingDriver) Handles(imageType string) bool {
 	return d.shouldHandle
 }
-func (d *mockFailingDriver) Run(op *driver.Operation) error {
-	return errors.New("I always fail")
+func (d *mockFailingDriver) Run(op *driver.Operation) (driver.OperationResult, error) {
+	return driver.OperationResult{}, errors.New("I always fail")
 }
 
 func mockBundle() *bundle.Bundle {
@@ -115,14 +115,165 @@ func TestOpFromClaim(t *testing.T) {
 	is.Equal(op.Environment["CNAB_P_PARAM_ONE"], "oneval")
 	is.Equal(op.Files["/secret/two"], "I'm also a secret")
 	is.Equal(op.Files["/param/three"], "threeval")
+	is.Equal(map[string]os.FileMode{
+		"/foo/bar":    CredentialFileMode,
+		"/secret/two": CredentialFileMode,
+	}, op.FileModes)
 	is.Contains(op.Files, "/cnab/app/image-map.json")
 	var imgMap map[string]bundle.Image
 	is.NoError(json.Unmarshal([]byte(op.Files["/cnab/app/image-map.json"]), &imgMap))
 	is.Equal(c.Bundle.Images, imgMap)
 	is.Len(op.Parameters, 3)
+	is.Equal(c.Bundle, op.Bundle)
 	is.Equal(os.Stdout, op.Out)
 }
 
+func TestOpFromClaim_StandardEnvironment(t *testing.T) {
+	now := time.Now()
+	c := &claim.Claim{
+		Created:  now,
+		Modified: now,
+		Name:     "name",
+		Revision: "01D2RPQNVF7KAYM9XBHV3TKEZ1",
+		Bundle:   mockBundle(),
+	}
+
+	op, err := opFromClaim("test", notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is := assert.New(t)
+	is.Equal("name", op.Environment["CNAB_INSTALLATION_NAME"])
+	is.Equal("test", op.Environment["CNAB_ACTION"])
+	is.Equal("bar", op.Environment["CNAB_BUNDLE_NAME"])
+	is.Equal("0.1.0", op.Environment["CNAB_BUNDLE_VERSION"])
+	is.Equal("01D2RPQNVF7KAYM9XBHV3TKEZ1", op.Environment["CNAB_REVISION"])
+}
+
+func TestOpFromClaim_Labels(t *testing.T) {
+	now := time.Now()
+	c := &claim.Claim{
+		Created:  now,
+		Modified: now,
+		Name:     "name",
+		Revision: "revision",
+		Bundle:   mockBundle(),
+	}
+	c.Bundle.Keywords = []string{"helm", "kubernetes"}
+	c.Bundle.Maintainers = []bundle.Maintainer{{Name: "sally"}, {Name: "bob", Email: "bob@example.com"}}
+
+	op, err := opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drivers label the invocation container from the bundle of the operation.
+	assert.Empty(t, op.Labels)
+	assert.Equal(t, map[string]string{
+		"io.cnab.bundle.name":        "bar",
+		"io.cnab.bundle.version":     "0.1.0",
+		"io.cnab.bundle.keywords":    "helm,kubernetes",
+		"io.cnab.bundle.maintainers": "sally,bob",
+	}, driver.BundleLabels(op.Bundle))
+}
+
+func TestOpFromClaim_Modifiers(t *testing.T) {
+	now := time.Now()
+	c := &claim.Claim{
+		Created:  now,
+		Modified: now,
+		Name:     "name",
+		Revision: "revision",
+		Bundle:   mockBundle(),
+	}
+	c.Bundle.Actions = map[string]bundle.Action{"logs": {Stateless: true}}
+
+	op, err := opFromClaim("logs", true, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, driver.ActionModifiers{Stateless: true}, op.Modifiers)
+
+	op, err = opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, driver.ActionModifiers{Modifies: true}, op.Modifiers)
+}
+
+func TestOpFromClaim_RelocationMap(t *testing.T) {
+	now := time.Now()
+	c := &claim.Claim{
+		Created:  now,
+		Modified: now,
+		Name:     "name",
+		Revision: "revision",
+		Bundle:   mockBundle(),
+		RelocationMap: bundle.ImageRelocationMap{
+			"foo/bar:0.1.0": "registry.example.com/foo/bar:0.1.0",
+		},
+	}
+
+	op, err := opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is := assert.New(t)
+	is.JSONEq(`{
+		"image-a": {
+			"imageType": "docker",
+			"image": "registry.example.com/foo/bar:0.1.0",
+			"description": "description"
+		}
+	}`, op.Files["/cnab/app/image-map.json"])
+	// The bundle itself is left untouched.
+	is.Equal("foo/bar:0.1.0", c.Bundle.Images["image-a"].Image)
+}
+
+func TestOpFromClaim_MalformedRelocationMap(t *testing.T) {
+	now := time.Now()
+	c := &claim.Claim{
+		Created:  now,
+		Modified: now,
+		Name:     "name",
+		Revision: "revision",
+		Bundle:   mockBundle(),
+		RelocationMap: bundle.ImageRelocationMap{
+			"foo/bar:0.1.0": "",
+		},
+	}
+
+	_, err := opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	assert.EqualError(t, err, `unable to generate image map: invalid image relocation map: invalid relocated reference "" for foo/bar:0.1.0: invalid reference format`)
+}
+
+func TestOpFromClaim_CollidingFiles(t *testing.T) {
+	now := time.Now()
+	b := mockBundle()
+	b.Parameters["param_three"] = bundle.ParameterDefinition{
+		Destination: &bundle.Location{Path: "/secret/two"},
+	}
+	c := &claim.Claim{
+		Created:    now,
+		Modified:   now,
+		Name:       "name",
+		Revision:   "revision",
+		Bundle:     b,
+		Parameters: map[string]interface{}{"param_three": "threeval"},
+	}
+
+	_, err := opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	assert.EqualError(t, err, `credential "secret_two" and parameter "param_three" are both injected at /secret/two`)
+
+	b.Parameters["param_three"] = bundle.ParameterDefinition{
+		Destination: &bundle.Location{Path: "/cnab/app/image-map.json"},
+	}
+	_, err = opFromClaim(claim.ActionInstall, notStateless, c, c.Bundle.InvocationImages[0], mockSet, os.Stdout)
+	assert.EqualError(t, err, `parameter "param_three" and the image map are both injected at /cnab/app/image-map.json`)
+}
+
 func TestOpFromClaim_UndefinedParams(t *testing.T) {
 	now := time.Now()
 	c := &claim.Claim{
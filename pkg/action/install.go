@@ -24,7 +24,7 @@ func (i *Install) Run(c *claim.Claim, creds credentials.Set, w io.Writer) error
 	if err != nil {
 		return err
 	}
-	if err := i.Driver.Run(op); err != nil {
+	if _, err := i.Driver.Run(op); err != nil {
 		c.Update(claim.ActionInstall, claim.StatusFailure)
 		c.Result.Message = err.Error()
 		return err
@@ -24,5 +24,6 @@ func (i *Status) Run(c *claim.Claim, creds credentials.Set, w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	return i.Driver.Run(op)
+	_, err = i.Driver.Run(op)
+	return err
 }
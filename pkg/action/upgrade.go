@@ -24,7 +24,7 @@ func (u *Upgrade) Run(c *claim.Claim, creds credentials.Set, w io.Writer) error
 	if err != nil {
 		return err
 	}
-	if err := u.Driver.Run(op); err != nil {
+	if _, err := u.Driver.Run(op); err != nil {
 		c.Update(claim.ActionUpgrade, claim.StatusFailure)
 		c.Result.Message = err.Error()
 		return err
@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/docker/go/canonical/json"
@@ -23,6 +24,7 @@ type Bundle struct {
 	Actions          map[string]Action              `json:"actions,omitempty" mapstructure:"actions"`
 	Parameters       map[string]ParameterDefinition `json:"parameters" mapstructure:"parameters"`
 	Credentials      map[string]Location            `json:"credentials" mapstructure:"credentials"`
+	Outputs          map[string]OutputDefinition    `json:"outputs,omitempty" mapstructure:"outputs"`
 }
 
 //Unmarshal unmarshals a Bundle that was not signed.
@@ -101,6 +103,26 @@ type Location struct {
 	EnvironmentVariable string `json:"env,omitempty" mapstructure:"env"`
 }
 
+// ImageNames returns the names of images in order.
+func ImageNames(images map[string]Image) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CredentialNames returns the names of credentials in order.
+func CredentialNames(credentials map[string]Location) []string {
+	names := make([]string, 0, len(credentials))
+	for name := range credentials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // Maintainer describes a code maintainer of a bundle
 type Maintainer struct {
 	// Name is a user name or organization name
@@ -197,3 +197,12 @@ func TestValidateBundle_RequiresInvocationImage(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCredentialNames(t *testing.T) {
+	names := CredentialNames(map[string]Location{"kubeconfig": {Path: "/root/.kube/config"}, "token": {EnvironmentVariable: "TOKEN"}})
+	assert.Equal(t, []string{"kubeconfig", "token"}, names)
+}
+
+func TestImageNames(t *testing.T) {
+	assert.Equal(t, []string{"db", "web"}, ImageNames(map[string]Image{"web": {}, "db": {}}))
+}
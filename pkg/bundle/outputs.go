@@ -0,0 +1,23 @@
+package bundle
+
+// OutputDefinition declares an output that the invocation image writes to a file
+type OutputDefinition struct {
+	// Path is the absolute path of the file the output is written to, below /cnab/app/outputs
+	Path        string   `json:"path" mapstructure:"path"`
+	Description string   `json:"description,omitempty" mapstructure:"description"`
+	ApplyTo     []string `json:"apply-to,omitempty" mapstructure:"apply-to,omitempty"`
+}
+
+// AppliesTo tells whether the output is produced by the given action. Outputs applying to
+// no action in particular are produced by all of them.
+func (od OutputDefinition) AppliesTo(action string) bool {
+	if len(od.ApplyTo) == 0 {
+		return true
+	}
+	for _, a := range od.ApplyTo {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,28 @@
+package bundle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOutputProperties(t *testing.T) {
+	b, err := Unmarshal([]byte(`{
+		"name": "foo",
+		"version": "1.0",
+		"outputs": {
+			"kubeconfig": {"path": "/cnab/app/outputs/kubeconfig", "description": "cluster credentials", "apply-to": ["install"]}
+		}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]OutputDefinition{
+		"kubeconfig": {Path: "/cnab/app/outputs/kubeconfig", Description: "cluster credentials", ApplyTo: []string{"install"}},
+	}, b.Outputs)
+}
+
+func TestOutputDefinition_AppliesTo(t *testing.T) {
+	is := assert.New(t)
+	is.True(OutputDefinition{}.AppliesTo("install"))
+	is.True(OutputDefinition{ApplyTo: []string{"install", "upgrade"}}.AppliesTo("upgrade"))
+	is.False(OutputDefinition{ApplyTo: []string{"install"}}.AppliesTo("uninstall"))
+}
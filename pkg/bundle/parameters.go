@@ -3,6 +3,7 @@ package bundle
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -27,6 +28,16 @@ type ParameterMetadata struct {
 	Description string `json:"description,omitempty" mapstructure:"description"`
 }
 
+// ParameterNames returns the names of parameter definitions in order.
+func ParameterNames(parameters map[string]ParameterDefinition) []string {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // ValidateParameterValue checks whether a value is valid as the value of
 // the specified parameter.
 func (pd ParameterDefinition) ValidateParameterValue(value interface{}) error {
@@ -372,6 +372,11 @@ func TestConvertValue(t *testing.T) {
 	is.Error(err)
 }
 
+func TestParameterNames(t *testing.T) {
+	names := ParameterNames(map[string]ParameterDefinition{"replicas": {}, "name": {}, "debug": {}})
+	assert.Equal(t, []string{"debug", "name", "replicas"}, names)
+}
+
 func intPtr(i int) *int {
 	return &i
 }
@@ -0,0 +1,42 @@
+package bundle
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/go/canonical/json"
+)
+
+// ImageRelocationMap maps the original references of the images of a bundle to the references
+// they were relocated to, such as when the bundle was copied to another registry.
+type ImageRelocationMap map[string]string
+
+// ParseImageRelocationMap reads a relocation map from a JSON object mapping original image
+// references to relocated ones.
+func ParseImageRelocationMap(data []byte) (ImageRelocationMap, error) {
+	m := ImageRelocationMap{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid image relocation map: %s", err)
+	}
+	return m, m.Validate()
+}
+
+// Validate checks that both the original and relocated references of the map are valid
+// image references.
+func (m ImageRelocationMap) Validate() error {
+	originals := make([]string, 0, len(m))
+	for original := range m {
+		originals = append(originals, original)
+	}
+	sort.Strings(originals)
+	for _, original := range originals {
+		if _, err := reference.ParseNormalizedNamed(original); err != nil {
+			return fmt.Errorf("invalid image relocation map: invalid original reference %q: %s", original, err)
+		}
+		if _, err := reference.ParseNormalizedNamed(m[original]); err != nil {
+			return fmt.Errorf("invalid image relocation map: invalid relocated reference %q for %s: %s", m[original], original, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package bundle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseImageRelocationMap(t *testing.T) {
+	m, err := ParseImageRelocationMap([]byte(`{
+		"docker.io/istio/citadel:1.0.2": "registry.example.com/istio/citadel:1.0.2",
+		"foo/bar@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "registry.example.com/foo/bar@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, ImageRelocationMap{
+		"docker.io/istio/citadel:1.0.2": "registry.example.com/istio/citadel:1.0.2",
+		"foo/bar@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "registry.example.com/foo/bar@sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, m)
+}
+
+func TestParseImageRelocationMap_Malformed(t *testing.T) {
+	is := assert.New(t)
+	for _, data := range []string{
+		`["docker.io/istio/citadel:1.0.2"]`,
+		`{"docker.io/istio/citadel:1.0.2": 42}`,
+		`{"docker.io/istio/citadel:1.0.2": "registry.example.com/istio/citadel:1.0.2"`,
+	} {
+		_, err := ParseImageRelocationMap([]byte(data))
+		is.Error(err, data)
+	}
+
+	_, err := ParseImageRelocationMap([]byte(`{"docker.io/istio/citadel:1.0.2": "Registry.example.com/Istio"}`))
+	is.EqualError(err, `invalid image relocation map: invalid relocated reference "Registry.example.com/Istio" for docker.io/istio/citadel:1.0.2: invalid reference format: repository name must be lowercase`)
+}
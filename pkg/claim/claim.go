@@ -43,6 +43,8 @@ type Claim struct {
 	Result     Result                 `json:"result"`
 	Parameters map[string]interface{} `json:"parameters"`
 	Files      map[string]string      `json:"files"`
+	// RelocationMap maps the images of the bundle to the references they were relocated to, if any
+	RelocationMap bundle.ImageRelocationMap `json:"relocationMap,omitempty"`
 }
 
 // ValidName is a regular expression that indicates whether a name is a valid claim name.
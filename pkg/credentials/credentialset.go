@@ -1,10 +1,12 @@
 package credentials
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/radu-matei/cnab-go/pkg/bundle"
@@ -41,12 +43,31 @@ func (s Set) Expand(b *bundle.Bundle, stateless bool) (env, files map[string]str
 	return
 }
 
+// ErrCredentialNotFound is returned by credential resolvers that have no value for a credential.
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// CredentialResolver looks up the value of credentials by name, from a source such as a secret
+// store, the environment or files.
+type CredentialResolver interface {
+	// Resolve returns the value of a credential, or an error wrapping ErrCredentialNotFound when
+	// it has none.
+	Resolve(name string) (value string, err error)
+}
+
 // CredentialSet represents a collection of credentials
 type CredentialSet struct {
 	// Name is the name of the credentialset.
 	Name string `json:"name" yaml:"name"`
 	// Creadentials is a list of credential specs.
 	Credentials []CredentialStrategy `json:"credentials" yaml:"credentials"`
+
+	resolver CredentialResolver
+}
+
+// SetCredentialResolver sets the resolver the values of the credentials are looked up with by
+// Resolve, instead of their source.
+func (c *CredentialSet) SetCredentialResolver(resolver CredentialResolver) {
+	c.resolver = resolver
 }
 
 // Load a CredentialSet from a file at a given path.
@@ -61,6 +82,66 @@ func Load(path string) (*CredentialSet, error) {
 	return cset, yaml.Unmarshal(data, cset)
 }
 
+// Rename renames the credential set oldName, stored as oldName.yaml in dir, to newName.
+//
+// Both the file and the name recorded in it are changed. It is an error for oldName
+// not to exist, or for newName to exist already.
+func Rename(dir, oldName, newName string) error {
+	for _, name := range []string{oldName, newName} {
+		if err := validateSetName(name); err != nil {
+			return err
+		}
+	}
+	oldPath := filepath.Join(dir, oldName+".yaml")
+	newPath := filepath.Join(dir, newName+".yaml")
+	info, err := os.Stat(oldPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("credential set %q does not exist", oldName)
+	}
+	if err != nil {
+		return err
+	}
+	cset, err := Load(oldPath)
+	if err != nil {
+		return fmt.Errorf("cannot load credential set %q: %s", oldName, err)
+	}
+	cset.Name = newName
+	data, err := yaml.Marshal(cset)
+	if err != nil {
+		return err
+	}
+	// The new file is created exclusively, so that a credential set created meanwhile is never overwritten.
+	f, err := os.OpenFile(newPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if os.IsExist(err) {
+		return fmt.Errorf("credential set %q already exists", newName)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	if err := os.Remove(oldPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return nil
+}
+
+// validateSetName checks that a credential set name designates a file of the credentials directory,
+// rather than a path such as ../other escaping it.
+func validateSetName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("invalid credential set name %q", name)
+	}
+	return nil
+}
+
 // Validate compares the given credentials with the spec.
 //
 // This will result in an error only if:
@@ -96,11 +177,21 @@ func isValidCred(haystack Set, needle string) bool {
 //	- Validate the credentials against a spec
 //	- Resolve the credentials
 //	- Expand them into bundle values
+//
+// When a credential resolver is set, the credentials are looked up with it instead.
 func (c *CredentialSet) Resolve() (Set, error) {
 	l := len(c.Credentials)
 	res := make(map[string]string, l)
 	for i := 0; i < l; i++ {
 		cred := c.Credentials[i]
+		if c.resolver != nil {
+			value, err := c.resolver.Resolve(cred.Name)
+			if err != nil {
+				return res, fmt.Errorf("credential %q: %s", cred.Name, err)
+			}
+			res[cred.Name] = value
+			continue
+		}
 		src := cred.Source
 		// Precedence is Command, Path, EnvVar, Value
 		switch {
@@ -2,9 +2,12 @@ package credentials
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/radu-matei/cnab-go/pkg/bundle"
@@ -51,6 +54,44 @@ func TestCredentialSet(t *testing.T) {
 	}
 }
 
+// fakeResolver resolves credentials from a map, as a secret store would.
+type fakeResolver map[string]string
+
+func (r fakeResolver) Resolve(name string) (string, error) {
+	value, ok := r[name]
+	if !ok {
+		return "", ErrCredentialNotFound
+	}
+	return value, nil
+}
+
+func TestCredentialSet_SetCredentialResolver(t *testing.T) {
+	is := assert.New(t)
+	credset := &CredentialSet{
+		Name: "staging",
+		Credentials: []CredentialStrategy{
+			{Name: "kubeconfig", Source: Source{Path: "/no/such/file"}},
+			{Name: "token", Source: Source{Value: "from source"}},
+		},
+	}
+	credset.SetCredentialResolver(fakeResolver{"kubeconfig": "config", "token": "secret"})
+
+	results, err := credset.Resolve()
+	is.NoError(err)
+	is.Equal(Set{"kubeconfig": "config", "token": "secret"}, results)
+}
+
+func TestCredentialSet_SetCredentialResolver_NotFound(t *testing.T) {
+	credset := &CredentialSet{
+		Name:        "staging",
+		Credentials: []CredentialStrategy{{Name: "token"}},
+	}
+	credset.SetCredentialResolver(fakeResolver{})
+
+	_, err := credset.Resolve()
+	assert.EqualError(t, err, `credential "token": credential not found`)
+}
+
 func TestCredentialSet_Expand(t *testing.T) {
 	b := &bundle.Bundle{
 		Name: "knapsack",
@@ -101,3 +142,107 @@ func TestCredentialSetMissingCred(t *testing.T) {
 	_, _, err = cs.Expand(b, true)
 	assert.NoError(t, err)
 }
+
+func TestRename(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "credentials")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile("testdata/staging-unix.yaml")
+	is.NoError(err)
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "staging.yaml"), data, 0600))
+
+	is.NoError(Rename(dir, "staging", "production"))
+
+	_, err = os.Stat(filepath.Join(dir, "staging.yaml"))
+	is.True(os.IsNotExist(err))
+	info, err := os.Stat(filepath.Join(dir, "production.yaml"))
+	is.NoError(err)
+	is.Equal(os.FileMode(0600), info.Mode().Perm())
+	credset, err := Load(filepath.Join(dir, "production.yaml"))
+	is.NoError(err)
+	is.Equal("production", credset.Name)
+	is.Len(credset.Credentials, 5)
+}
+
+func TestRename_MissingSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.EqualError(t, Rename(dir, "staging", "production"), `credential set "staging" does not exist`)
+}
+
+func TestRename_ExistingTarget(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "credentials")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "staging.yaml"), []byte("name: staging\n"), 0600))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "production.yaml"), []byte("name: production\n"), 0600))
+
+	is.EqualError(Rename(dir, "staging", "production"), `credential set "production" already exists`)
+	credset, err := Load(filepath.Join(dir, "production.yaml"))
+	is.NoError(err)
+	is.Equal("production", credset.Name)
+}
+
+func TestRename_ConcurrentTarget(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "credentials")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	const n = 8
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("staging-%d", i)
+		is.NoError(ioutil.WriteFile(filepath.Join(dir, name+".yaml"), []byte("name: "+name+"\n"), 0600))
+	}
+
+	// Only one of the credential sets renamed to the same name at once may take it.
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- Rename(dir, fmt.Sprintf("staging-%d", i), "production")
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	renamed := 0
+	for err := range errs {
+		if err == nil {
+			renamed++
+			continue
+		}
+		is.EqualError(err, `credential set "production" already exists`)
+	}
+	is.Equal(1, renamed)
+	files, err := ioutil.ReadDir(dir)
+	is.NoError(err)
+	is.Len(files, n)
+}
+
+func TestRename_InvalidName(t *testing.T) {
+	is := assert.New(t)
+	parent, err := ioutil.TempDir("", "credentials")
+	is.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "credentials")
+	is.NoError(os.Mkdir(dir, 0755))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "staging.yaml"), []byte("name: staging\n"), 0600))
+	is.NoError(ioutil.WriteFile(filepath.Join(parent, "outside.yaml"), []byte("name: outside\n"), 0600))
+
+	is.EqualError(Rename(dir, "staging", "../escaped"), `invalid credential set name "../escaped"`)
+	is.EqualError(Rename(dir, "../outside", "stolen"), `invalid credential set name "../outside"`)
+	is.EqualError(Rename(dir, "staging", ".."), `invalid credential set name ".."`)
+	is.EqualError(Rename(dir, "staging", `nested\name`), `invalid credential set name "nested\\name"`)
+
+	_, err = os.Stat(filepath.Join(dir, "staging.yaml"))
+	is.NoError(err)
+	_, err = os.Stat(filepath.Join(parent, "outside.yaml"))
+	is.NoError(err)
+	_, err = os.Stat(filepath.Join(parent, "escaped.yaml"))
+	is.True(os.IsNotExist(err))
+}
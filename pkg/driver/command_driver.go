@@ -15,8 +15,8 @@ type CommandDriver struct {
 }
 
 // Run executes the command
-func (d *CommandDriver) Run(op *Operation) error {
-	return d.exec(op)
+func (d *CommandDriver) Run(op *Operation) (OperationResult, error) {
+	return OperationResult{}, d.exec(op)
 }
 
 // Handles executes the driver with `--handles` and parses the results
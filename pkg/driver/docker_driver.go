@@ -2,25 +2,91 @@ package driver
 
 import (
 	"archive/tar"
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	unix_path "path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/config/configfile"
 	cliflags "github.com/docker/cli/cli/flags"
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	registrytypes "github.com/docker/docker/api/types/registry"
 	"github.com/docker/docker/api/types/strslice"
+	volumetypes "github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/docker/registry"
 )
 
+// DriverLabel is the label set on the containers created by the Docker driver
+const DriverLabel = "io.cnab.driver"
+
+// defaultStartRetry is used to start containers unless SetStartRetry is called
+var defaultStartRetry = retryPolicy{attempts: 3, backoff: 500 * time.Millisecond}
+
+// defaultTarModTime is the modification time of the files injected into the container unless
+// SetTarModTime is called, so that the archive is the same across runs
+var defaultTarModTime = time.Unix(0, 0)
+
+// defaultOutputDrainGrace bounds how long a run waits for the output of its container to be copied
+// once the container exited, unless SetOutputDrainGrace is called
+const defaultOutputDrainGrace = 2 * time.Second
+
+// fetchOutputsRetry is used to copy the outputs out of a container that just exited, while its
+// filesystem may still be settling
+var fetchOutputsRetry = retryPolicy{attempts: 4, backoff: 250 * time.Millisecond}
+
+// renameOutput moves the outputs fetched by FetchOutputsToDir into place, and back on failure
+var renameOutput = os.Rename
+
+// runContextPath is the path of the file describing the operation, injected into the invocation
+// image when enabled with SetInjectRunContext
+const runContextPath = "/cnab/app/run-context.json"
+
+// defaultEntrypoint runs the operation in invocation images of types without an entrypoint of their own
+var defaultEntrypoint = strslice.StrSlice{"/cnab/app/run"}
+
+// keepAliveEntrypoint keeps the container running with a shell, when SetDebugShell is enabled or
+// to execute the command set with SetPostRunExec once the invocation image is done
+var keepAliveEntrypoint = strslice.StrSlice{"/bin/sh", "-c", "tail -f /dev/null"}
+
+// defaultCleanupStopTimeout is how long a container still running when the operation returns is
+// given to stop before it is removed, unless SetRemoveGrace is called
+const defaultCleanupStopTimeout = 10 * time.Second
+
+// outputsDir is the directory of the invocation image in which bundles write their outputs
+const outputsDir = "/cnab/app/outputs"
+
+// cnabDir is the directory of the invocation image holding the bundle. With a read-only root file
+// system, it is mounted from a volume, to which the files of operations are copied.
+const cnabDir = "/cnab"
+
+// hostnamePattern matches RFC 1123 hostnames: dot separated labels of up to 63 letters, digits
+// and hyphens, that do not start or end with a hyphen
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+// outputsBufferSize is the size of the buffer used to read the outputs archive of a container
+const outputsBufferSize = 64 * 1024
+
 // DockerDriver is capable of running Docker invocation images using Docker itself.
 type DockerDriver struct {
 	config map[string]string
@@ -30,11 +96,109 @@ type DockerDriver struct {
 	dockerConfigurationOptions []DockerConfigurationOption
 	containerOut               io.Writer
 	containerErr               io.Writer
+	logTail                    string
+	logSince                   time.Duration
+	healthcheck                *container.HealthConfig
+	shmSize                    int64
+	captureChanges             bool
+	cmd                        []string
+	fileUID                    int
+	fileGID                    int
+	tarModTime                 *time.Time
+	startRetry                 *retryPolicy
+	privileged                 bool
+	init                       *bool
+	traceEnv                   map[string]string
+	pidMode                    container.PidMode
+	tarDumpPath                string
+	cgroupParent               string
+	dockerHost                 string
+	dockerContext              string
+	memory                     int64
+	memorySwap                 int64
+	memorySwappiness           *int64
+	memoryReservation          int64
+	oomKillDisable             *bool
+	oomScoreAdj                int
+	mounts                     []mount.Mount
+	envAllowlist               map[string]bool
+	rejectDisallowedEnv        bool
+	architecture               string
+	runTimeout                 time.Duration
+	allowOverwriteDirWithFile  bool
+	metrics                    MetricsRecorder
+	seccompProfile             string
+	postRunExec                []string
+	statsHandler               func(StatsSample)
+	workingDir                 string
+	hostname                   string
+	lastRunHash                string
+	traceContextInjector       TraceContextInjector
+	forceRemove                bool
+	removeGrace                time.Duration
+	removeErrorHandler         func(containerID string, err error)
+	requireDigest              bool
+	skipOutputs                bool
+	injectRunContext           bool
+	logConfig                  container.LogConfig
+	runtime                    string
+	verifyRuntime              bool
+	localImages                map[string]io.Reader
+	localImagesMu              sync.Mutex
+	runManifest                bool
+	debugShell                 bool
+	uploadProgress             func(copied, total int64)
+	containerStopTimeout       *int
+	sysctls                    map[string]string
+	entrypoints                map[string][]string
+	eventLog                   io.Writer
+	hardened                   bool
+	imageResolver              func(string) (string, error)
+	isolation                  container.Isolation
+	maxConcurrentPulls         int
+	onContainerCreated         func(id string)
+	exitCodeClassifier         func(code int) (success bool, err error)
+	logFile                    string
+	rotateLogFile              bool
+	outputDrainGrace           *time.Duration
+	dockerConfigJSON           string
+}
+
+// RunContext is the content of /cnab/app/run-context.json, describing the operation to the
+// invocation image.
+type RunContext struct {
+	Action       string    `json:"action"`
+	Installation string    `json:"installation"`
+	Revision     string    `json:"revision,omitempty"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// TraceContextInjector writes the W3C trace context of ctx, if any, to headers, under the
+// traceparent and tracestate keys.
+//
+// With OpenTelemetry, it is:
+//
+//	func(ctx context.Context, headers map[string]string) {
+//		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(headers))
+//	}
+type TraceContextInjector func(ctx context.Context, headers map[string]string)
+
+// traceContextEnv maps the W3C trace context headers to the environment variables they are
+// injected as.
+var traceContextEnv = map[string]string{
+	"traceparent": "TRACEPARENT",
+	"tracestate":  "TRACESTATE",
 }
 
 // Run executes the Docker driver
-func (d *DockerDriver) Run(op *Operation) error {
-	return d.exec(op)
+func (d *DockerDriver) Run(op *Operation) (OperationResult, error) {
+	start := time.Now()
+	events := newEventLog(d.eventLog, op, start)
+	events.emit(Event{Type: EventRunStarted, Image: op.Image})
+	result, err := d.exec(op, events)
+	recordRun(d.metrics, op.Action, start, err)
+	events.finished(err)
+	return result, err
 }
 
 // Handles indicates that the Docker driver supports "docker" and "oci"
@@ -53,6 +217,7 @@ func (d *DockerDriver) Config() map[string]string {
 		"VERBOSE":             "Increase verbosity. true, false are supported values",
 		"PULL_ALWAYS":         "Always pull image, even if locally available (0|1)",
 		"DOCKER_DRIVER_QUIET": "Make the Docker driver quiet (only print container stdout/stderr)",
+		"OUTPUTS_MOUNT_PATH":  "Host directory in which to create a temporary directory mounted as the outputs directory, instead of copying outputs from the container",
 	}
 }
 
@@ -76,7 +241,707 @@ func (d *DockerDriver) SetContainerErr(w io.Writer) {
 	d.containerErr = w
 }
 
-func pullImage(ctx context.Context, cli command.Cli, image string) error {
+// SetLogOptions bounds the container logs that are streamed during a run.
+//
+// tail is the number of lines to show from the end of the logs ("all" or empty for no limit),
+// and since only shows logs produced within that duration (0 for no limit).
+// When neither is set, the driver attaches to the container and streams all of its output.
+func (d *DockerDriver) SetLogOptions(tail string, since time.Duration) {
+	d.logTail = tail
+	d.logSince = since
+}
+
+// SetLogConfig sets the logging driver of the container, such as json-file, journald or fluentd,
+// and its options, such as max-size for json-file.
+//
+// Only the json-file, local and journald drivers can be read back: with other drivers, the output
+// of the container is still streamed while attached to it, but SetLogOptions cannot be used.
+func (d *DockerDriver) SetLogConfig(driver string, opts map[string]string) {
+	d.logConfig = container.LogConfig{Type: driver, Config: opts}
+}
+
+// SetLogFile sets a file the combined output of the container of each run is copied to, in addition
+// to being streamed to the output writers.
+//
+// By default, a run fails rather than overwrite an existing log file, see SetRotateLogFile.
+func (d *DockerDriver) SetLogFile(path string) {
+	d.logFile = path
+}
+
+// SetRotateLogFile makes a run rename the existing log file, appending its modification time to
+// its name (e.g. run.log.20190102T150405Z), instead of failing.
+func (d *DockerDriver) SetRotateLogFile(rotate bool) {
+	d.rotateLogFile = rotate
+}
+
+// SetOutputDrainGrace sets how long a run waits, once its container exited, for the rest of the
+// output of the container to be copied to the output writers. Output still unread after that is lost.
+//
+// The default is 2 seconds.
+func (d *DockerDriver) SetOutputDrainGrace(grace time.Duration) {
+	d.outputDrainGrace = &grace
+}
+
+// drainOutput waits for streamed to be closed, for at most the output drain grace.
+func (d *DockerDriver) drainOutput(streamed <-chan struct{}) {
+	grace := defaultOutputDrainGrace
+	if d.outputDrainGrace != nil {
+		grace = *d.outputDrainGrace
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-streamed:
+	case <-timer.C:
+	}
+}
+
+// SetHealthcheck overrides the healthcheck defined by the invocation image.
+//
+// test is the check to run, in the same format as the HEALTHCHECK instruction of a Dockerfile
+// (e.g. ["CMD", "/cnab/app/healthy"] or ["CMD-SHELL", "curl -f http://localhost"]).
+// Zero durations and retries inherit the image or daemon defaults.
+func (d *DockerDriver) SetHealthcheck(test []string, interval, timeout time.Duration, retries int) {
+	d.healthcheck = &container.HealthConfig{
+		Test:     test,
+		Interval: interval,
+		Timeout:  timeout,
+		Retries:  retries,
+	}
+}
+
+// DisableHealthcheck disables any healthcheck defined by the invocation image.
+func (d *DockerDriver) DisableHealthcheck() {
+	d.healthcheck = &container.HealthConfig{Test: []string{"NONE"}}
+}
+
+// SetCmd sets the arguments passed to the invocation image entrypoint, /cnab/app/run.
+//
+// By default, the entrypoint is run without arguments.
+func (d *DockerDriver) SetCmd(cmd []string) {
+	d.cmd = cmd
+}
+
+// SetEntrypoint sets the entrypoint run in invocation images of the given image type, such as
+// ImageTypeOCI, for tooling that builds them with a different run command.
+//
+// By default, invocation images of every type run /cnab/app/run.
+func (d *DockerDriver) SetEntrypoint(imageType string, entrypoint []string) {
+	if d.entrypoints == nil {
+		d.entrypoints = map[string][]string{}
+	}
+	d.entrypoints[imageType] = entrypoint
+}
+
+// entrypoint returns the entrypoint of invocation images of the given image type.
+func (d *DockerDriver) entrypoint(imageType string) strslice.StrSlice {
+	if entrypoint, ok := d.entrypoints[imageType]; ok {
+		return entrypoint
+	}
+	return defaultEntrypoint
+}
+
+// SetFileOwner sets the user and group owning the files injected into the container.
+//
+// By default, injected files are owned by root. When the invocation image runs as a
+// non-root user, this should match that user so the files remain readable.
+func (d *DockerDriver) SetFileOwner(uid, gid int) {
+	d.fileUID = uid
+	d.fileGID = gid
+}
+
+// SetTarModTime sets the modification time of the files injected into the container.
+//
+// By default, it is the Unix epoch, so that the archive only depends on the files.
+func (d *DockerDriver) SetTarModTime(t time.Time) {
+	d.tarModTime = &t
+}
+
+func (d *DockerDriver) fileModTime() time.Time {
+	if d.tarModTime == nil {
+		return defaultTarModTime
+	}
+	return *d.tarModTime
+}
+
+// SetStartRetry sets how many times creating and starting a container are attempted when the
+// daemon fails with a transient error, such as "device or resource busy", and the delay before
+// the first retry. The delay doubles after each attempt.
+//
+// By default, each is attempted 3 times, starting with a 500ms delay.
+// Permanent errors, such as a missing image or container, are never retried, nor is creating a
+// container after the connection to the daemon failed, as the container may have been created.
+func (d *DockerDriver) SetStartRetry(attempts int, backoff time.Duration) {
+	d.startRetry = &retryPolicy{attempts: attempts, backoff: backoff}
+}
+
+func (d *DockerDriver) startRetryPolicy() retryPolicy {
+	if d.startRetry == nil {
+		return defaultStartRetry
+	}
+	return *d.startRetry
+}
+
+// SetPrivileged runs the invocation image in privileged mode.
+//
+// WARNING: a privileged container has all capabilities and access to all the devices of the host,
+// which effectively gives the bundle root access to the machine running Docker. Only enable this
+// for bundles that are fully trusted, and after the user has explicitly agreed to it.
+func (d *DockerDriver) SetPrivileged(privileged bool) {
+	d.privileged = privileged
+}
+
+// SetInit controls whether Docker runs an init process in the container, which forwards
+// signals and reaps the zombie processes left by the invocation image.
+//
+// When unset, the daemon's configuration applies.
+func (d *DockerDriver) SetInit(init bool) {
+	d.init = &init
+}
+
+// SetTraceEnv sets environment variables injected into every operation, such as the
+// identifier of the build, commit or pipeline that triggered it, for traceability.
+//
+// Variables of the operation's environment take precedence over these.
+func (d *DockerDriver) SetTraceEnv(env map[string]string) {
+	d.traceEnv = env
+}
+
+// SetTraceContextInjector enables the propagation of the trace of operations into the invocation
+// image: the trace context of Operation.Context, when it carries a trace, is injected as the
+// TRACEPARENT and TRACESTATE environment variables, so the invocation image can continue it.
+//
+// Variables of the operation's environment take precedence over these.
+func (d *DockerDriver) SetTraceContextInjector(inject TraceContextInjector) {
+	d.traceContextInjector = inject
+}
+
+// SetPidMode sets the PID namespace of the container: "host" to share the host's PID namespace,
+// or "container:<name|id>" to join the namespace of another container.
+//
+// WARNING: in host mode, the invocation image can see and signal every process of the host.
+// Only use it for trusted bundles that need it, such as debugging or monitoring tools.
+func (d *DockerDriver) SetPidMode(mode string) error {
+	pidMode := container.PidMode(mode)
+	if !pidMode.Valid() {
+		return fmt.Errorf("invalid PID mode %q", mode)
+	}
+	d.pidMode = pidMode
+	return nil
+}
+
+// SetCgroupParent sets the parent cgroup under which the container is placed, so its resource
+// usage can be accounted for and limited along with the other containers of that cgroup.
+func (d *DockerDriver) SetCgroupParent(parent string) {
+	d.cgroupParent = parent
+}
+
+// SetDockerHost sets the address of the Docker daemon to connect to, such as tcp://host:2376
+// or ssh://user@host, instead of the default daemon.
+func (d *DockerDriver) SetDockerHost(host string) {
+	d.dockerHost = host
+}
+
+// SetDockerContext sets the Docker context used to connect to the daemon.
+func (d *DockerDriver) SetDockerContext(name string) {
+	d.dockerContext = name
+}
+
+// SetMemory limits the memory, in bytes, the container can use.
+func (d *DockerDriver) SetMemory(bytes int64) {
+	d.memory = bytes
+}
+
+// SetMemorySwap limits the memory plus swap, in bytes, the container can use, -1 allowing
+// unlimited swap. When a memory limit is also set, it must not be lower than that limit.
+//
+// When unset, the container can use as much swap as memory.
+func (d *DockerDriver) SetMemorySwap(bytes int64) {
+	d.memorySwap = bytes
+}
+
+// SetMemorySwappiness tunes how likely the kernel is to swap out the container's
+// anonymous pages, from 0 to 100.
+func (d *DockerDriver) SetMemorySwappiness(swappiness int64) {
+	d.memorySwappiness = &swappiness
+}
+
+// AddVolume mounts the named Docker volume at containerPath, so that state can be kept across
+// operations. The volume is created if it does not exist yet.
+func (d *DockerDriver) AddVolume(volumeName, containerPath string, readOnly bool) {
+	d.mounts = append(d.mounts, mount.Mount{
+		Type:     mount.TypeVolume,
+		Source:   volumeName,
+		Target:   containerPath,
+		ReadOnly: readOnly,
+	})
+}
+
+// AddBindMount mounts the hostPath directory of the Docker host at containerPath.
+//
+// propagation controls whether mounts created below the directory after the container started are
+// seen on the other side, one of rprivate, private, rshared, shared, rslave and slave. An empty
+// propagation uses the default of Docker, rprivate.
+func (d *DockerDriver) AddBindMount(hostPath, containerPath string, readOnly bool, propagation string) error {
+	m := mount.Mount{
+		Type:     mount.TypeBind,
+		Source:   hostPath,
+		Target:   containerPath,
+		ReadOnly: readOnly,
+	}
+	if propagation != "" {
+		if !validPropagation(mount.Propagation(propagation)) {
+			return fmt.Errorf("invalid mount propagation %q", propagation)
+		}
+		m.BindOptions = &mount.BindOptions{Propagation: mount.Propagation(propagation)}
+	}
+	d.mounts = append(d.mounts, m)
+	return nil
+}
+
+func validPropagation(propagation mount.Propagation) bool {
+	for _, p := range mount.Propagations {
+		if p == propagation {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEnvAllowlist restricts the environment variables of the operation passed to the container
+// to the given names, so that secrets are not leaked to bundles by accident. Other variables
+// are dropped, unless SetRejectDisallowedEnv makes the operation fail instead.
+//
+// The allowlist applies to every variable of the operation, including the ones set by the
+// CNAB runtime, such as CNAB_ACTION.
+func (d *DockerDriver) SetEnvAllowlist(names []string) {
+	d.envAllowlist = make(map[string]bool, len(names))
+	for _, name := range names {
+		d.envAllowlist[name] = true
+	}
+}
+
+// SetRejectDisallowedEnv makes operations with environment variables outside of the allowlist
+// fail, instead of silently dropping those variables.
+func (d *DockerDriver) SetRejectDisallowedEnv(reject bool) {
+	d.rejectDisallowedEnv = reject
+}
+
+// SetArchitecture sets the architecture, such as amd64 or arm64, invocation images must be built
+// for. Running an image built for another architecture fails before the container is started.
+//
+// When unset, the architecture of the Docker host is used, and nothing is checked when it cannot be retrieved.
+func (d *DockerDriver) SetArchitecture(arch string) {
+	d.architecture = arch
+}
+
+// SetRunTimeout bounds how long the invocation image may run. A container still running after
+// that delay is stopped, and the operation fails with a timeout error.
+//
+// By default, the driver waits for the container to exit for as long as it takes.
+func (d *DockerDriver) SetRunTimeout(timeout time.Duration) {
+	d.runTimeout = timeout
+}
+
+// SetExitCodeClassifier sets a function deciding whether the exit code of the invocation image is a
+// success, for bundles giving a meaning to some non-zero codes, such as 2 for an installation that
+// was already done. Outputs are fetched for the codes classified as successful, and the operation
+// does not fail. For the other codes, the error returned by the classifier fails the operation,
+// or the usual exit code error when it is nil.
+//
+// By default, only 0 is a success. The exit code of the invocation image is reported in
+// OperationResult.ExitCode either way.
+func (d *DockerDriver) SetExitCodeClassifier(classifier func(code int) (success bool, err error)) {
+	d.exitCodeClassifier = classifier
+}
+
+func (d *DockerDriver) classifyExitCode(code int) (bool, error) {
+	if d.exitCodeClassifier == nil {
+		return code == 0, nil
+	}
+	return d.exitCodeClassifier(code)
+}
+
+// SetAllowOverwriteDirWithFile allows the files injected into the container to replace
+// directories existing at the same path in the invocation image.
+//
+// WARNING: the whole directory, with everything the invocation image stored in it, is replaced
+// by the file. This is disabled by default, so injecting a file over a directory fails instead.
+func (d *DockerDriver) SetAllowOverwriteDirWithFile(allow bool) {
+	d.allowOverwriteDirWithFile = allow
+}
+
+// SetEventLog sets a writer the events of each run, such as the creation of its container or
+// the exit code of the invocation image, are written to, as newline-delimited JSON objects of
+// type Event. Unlike the output of the driver, the event log is meant to be parsed, for instance
+// by CI systems collecting it as an artifact.
+func (d *DockerDriver) SetEventLog(w io.Writer) {
+	d.eventLog = w
+}
+
+// SetOnContainerCreated sets a function called with the ID of the container of each run once it
+// is created, before it is started. The container can then be stopped out of band, for instance
+// by an interactive tool offering to cancel the operation.
+func (d *DockerDriver) SetOnContainerCreated(callback func(id string)) {
+	d.onContainerCreated = callback
+}
+
+// SetImageResolver sets a function resolving the invocation image references of operations,
+// such as short names without a registry, to the references that are pulled and run.
+//
+// By default, references are used as they are.
+func (d *DockerDriver) SetImageResolver(resolver func(string) (string, error)) {
+	d.imageResolver = resolver
+}
+
+// SetMetrics sets the recorder to which the count, duration and status of runs are reported.
+func (d *DockerDriver) SetMetrics(metrics MetricsRecorder) {
+	d.metrics = metrics
+}
+
+// SetMemoryReservation sets a soft limit, in bytes, on the memory of the container: the container
+// may use more, but is shrunk back towards it when the host runs low on memory. When a memory limit
+// is also set, the reservation must not be greater than that limit.
+func (d *DockerDriver) SetMemoryReservation(bytes int64) {
+	d.memoryReservation = bytes
+}
+
+// SetOOMKillDisable disables, or enables back, the OOM killer for the container.
+//
+// WARNING: without a memory limit set with SetMemory, a container the OOM killer is disabled for
+// can exhaust the memory of the host, and the kernel then kills other processes instead.
+func (d *DockerDriver) SetOOMKillDisable(disable bool) {
+	d.oomKillDisable = &disable
+}
+
+// SetOOMScoreAdj adjusts how likely the container is to be killed when the host runs out of
+// memory, from -1000 (never) to 1000 (first).
+func (d *DockerDriver) SetOOMScoreAdj(score int) {
+	d.oomScoreAdj = score
+}
+
+// SetSeccompProfileContent applies the given seccomp profile, such as one shipped with the bundle,
+// to the container. Unlike a profile path, the content does not need to exist on the Docker host.
+func (d *DockerDriver) SetSeccompProfileContent(profile []byte) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, profile); err != nil {
+		return fmt.Errorf("invalid seccomp profile: %v", err)
+	}
+	d.seccompProfile = compact.String()
+	return nil
+}
+
+// namespacedSysctls are the sysctls, outside of the fs.mqueue and net prefixes, that are namespaced
+// and can be set for a container without affecting the host
+var namespacedSysctls = map[string]bool{
+	"kernel.msgmax":          true,
+	"kernel.msgmnb":          true,
+	"kernel.msgmni":          true,
+	"kernel.sem":             true,
+	"kernel.shmall":          true,
+	"kernel.shmmax":          true,
+	"kernel.shmmni":          true,
+	"kernel.shm_rmid_forced": true,
+}
+
+// SetSysctl sets a kernel parameter, such as net.core.somaxconn, for the container.
+//
+// Only namespaced parameters, that do not affect the host, can be set: the IPC parameters
+// kernel.msg*, kernel.sem, kernel.shm* and fs.mqueue.*, and the network parameters net.*.
+func (d *DockerDriver) SetSysctl(key, value string) error {
+	if !namespacedSysctls[key] && !strings.HasPrefix(key, "fs.mqueue.") && !strings.HasPrefix(key, "net.") {
+		return fmt.Errorf("sysctl %s is not namespaced and cannot be set for a container", key)
+	}
+	if d.sysctls == nil {
+		d.sysctls = map[string]string{}
+	}
+	d.sysctls[key] = value
+	return nil
+}
+
+// SetHardened runs invocation images with a read-only root file system, without any capability
+// and without the ability to gain privileges, for instance through setuid binaries. A writable
+// tmpfs file system is mounted at /tmp.
+//
+// Configuration options added with AddConfigurationOptions can still override these settings.
+//
+// As with any read-only root file system, /cnab is mounted from a volume created for the container
+// from the content of the image, so that the files of the operation can be copied and its outputs
+// written. The files of the operation must then be below /cnab.
+func (d *DockerDriver) SetHardened(hardened bool) {
+	d.hardened = hardened
+}
+
+// SetIsolation sets the isolation technology of the container on Windows hosts: "process",
+// "hyperv", or "default" to use the default of the Docker daemon.
+func (d *DockerDriver) SetIsolation(isolation string) error {
+	i := container.Isolation(isolation)
+	if !i.IsDefault() && !i.IsProcess() && !i.IsHyperV() {
+		return fmt.Errorf("unsupported isolation %q, it should be one of default, process or hyperv", isolation)
+	}
+	d.isolation = i
+	return nil
+}
+
+// SetPostRunExec sets a command executed in the container once the invocation image's main process
+// has exited, whether it succeeded or not, such as a cleanup step. Its output is written along with
+// the output of the container.
+//
+// Docker only executes commands in running containers, so the container is then kept running with
+// /bin/sh, which the image must provide, and the invocation image is executed in it. Its output is
+// not available from the logs of the container.
+func (d *DockerDriver) SetPostRunExec(cmd []string) {
+	d.postRunExec = cmd
+}
+
+// SetStatsHandler sets a function receiving samples of the CPU and memory used by the container
+// while it runs, until it exits.
+//
+// Stats are not collected by default, as streaming them has a cost on the Docker daemon.
+func (d *DockerDriver) SetStatsHandler(handler func(StatsSample)) {
+	d.statsHandler = handler
+}
+
+// SetWorkingDir sets the working directory of the invocation image. Files of the operation with
+// a relative destination path are injected relative to it.
+func (d *DockerDriver) SetWorkingDir(dir string) error {
+	if !unix_path.IsAbs(dir) {
+		return fmt.Errorf("working directory %s should be an absolute unix path", dir)
+	}
+	d.workingDir = dir
+	return nil
+}
+
+// SetHostname sets the hostname of the container, which must be a valid RFC 1123 hostname.
+func (d *DockerDriver) SetHostname(hostname string) error {
+	if len(hostname) > 253 || !hostnamePattern.MatchString(hostname) {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	d.hostname = hostname
+	return nil
+}
+
+// SetLastRunHash sets the hash of the last operation run, as returned by Operation.Hash.
+//
+// Operations with that same hash are not run again: Run returns a result with Unchanged set
+// instead, which gives idempotent semantics to callers persisting the hash between runs.
+func (d *DockerDriver) SetLastRunHash(hash string) {
+	d.lastRunHash = hash
+}
+
+// SetForceRemove makes the driver force the removal of the container once the operation is over,
+// killing it if it is somehow still running, instead of failing to remove it.
+func (d *DockerDriver) SetForceRemove(force bool) {
+	d.forceRemove = force
+}
+
+// SetRemoveGrace sets how long a container possibly still running when the operation returns,
+// such as after a failure to start it, is given to exit after being sent SIGTERM, before it is
+// killed and removed.
+//
+// It defaults to 10 seconds.
+func (d *DockerDriver) SetRemoveGrace(grace time.Duration) {
+	d.removeGrace = grace
+}
+
+// SetRemoveErrorHandler sets a function called with the errors met when removing the container
+// once the operation is over. These errors do not fail the operation.
+//
+// By default, they are written to the output stream of the operation.
+func (d *DockerDriver) SetRemoveErrorHandler(handler func(containerID string, err error)) {
+	d.removeErrorHandler = handler
+}
+
+// SetDockerConfigJSON sets the path of a file in the .dockerconfigjson format of Kubernetes image pull
+// secrets, holding the credentials of registries in an auths map. Images are then pulled with the
+// credentials of their registry from that file, instead of those of the Docker CLI configuration.
+//
+// The file is read on each pull, so that it can be updated, for instance when a secret is rotated.
+func (d *DockerDriver) SetDockerConfigJSON(path string) {
+	d.dockerConfigJSON = path
+}
+
+// SetRequireDigest makes the driver refuse to run invocation images that are not referenced by
+// digest, such as example.com/bundle@sha256:..., so that the image run is exactly the one
+// expected. Tags can be moved to another image, digests cannot.
+//
+// Whether required or not, the image of a reference by digest is checked to match that digest.
+func (d *DockerDriver) SetRequireDigest(require bool) {
+	d.requireDigest = require
+}
+
+// SetMaxConcurrentPulls sets how many images PullBundleImages pulls at once, to avoid overwhelming
+// the daemon or hitting the rate limits of registries. A value below 1 restores the default of 3.
+func (d *DockerDriver) SetMaxConcurrentPulls(n int) {
+	d.maxConcurrentPulls = n
+}
+
+// SetFetchOutputs controls whether the outputs of the invocation image are copied from the
+// container once it exits successfully. When disabled, OperationResult.Outputs is nil.
+//
+// Outputs are fetched by default.
+func (d *DockerDriver) SetFetchOutputs(fetch bool) {
+	d.skipOutputs = !fetch
+}
+
+// SetInjectRunContext makes the driver inject a /cnab/app/run-context.json file, holding the
+// RunContext of the operation, into the invocation image.
+func (d *DockerDriver) SetInjectRunContext(inject bool) {
+	d.injectRunContext = inject
+}
+
+// SetRuntime sets the OCI runtime running the container, such as runsc for gVisor or
+// kata-runtime for Kata Containers, for a stronger isolation of the invocation image.
+//
+// The runtime must be registered with the Docker daemon. By default, the daemon's default
+// runtime is used.
+func (d *DockerDriver) SetRuntime(runtime string) {
+	d.runtime = runtime
+}
+
+// SetVerifyRuntime makes the driver check that the runtime set with SetRuntime is registered
+// with the Docker daemon before creating the container, to fail with a clear error if not.
+func (d *DockerDriver) SetVerifyRuntime(verify bool) {
+	d.verifyRuntime = verify
+}
+
+// AddLocalImage provides the archive of an image, as produced by docker save, to load into the
+// Docker daemon instead of pulling the image from its registry.
+//
+// The archive is loaded once, by the first run of an operation using ref. The image then stays
+// available in the daemon.
+func (d *DockerDriver) AddLocalImage(ref string, r io.Reader) {
+	d.localImagesMu.Lock()
+	defer d.localImagesMu.Unlock()
+	if d.localImages == nil {
+		d.localImages = map[string]io.Reader{}
+	}
+	d.localImages[ref] = r
+}
+
+// SetRunManifest makes the driver report a RunManifest in the result of operations, describing
+// the image, command, environment, files and host configuration of the container that was run.
+func (d *DockerDriver) SetRunManifest(enabled bool) {
+	d.runManifest = enabled
+}
+
+// SetDebugShell starts the container of operations with a shell that keeps it running, instead
+// of running /cnab/app/run, so that the invocation image can be debugged by executing commands
+// in it. Instructions to do so are written to the output stream of the operation.
+//
+// In this mode, the container is neither waited for nor removed, and outputs are not fetched.
+// It is meant for debugging only.
+func (d *DockerDriver) SetDebugShell(debug bool) {
+	d.debugShell = debug
+}
+
+// SetUploadProgress sets a function called as the files of operations are copied into the
+// container, with the number of bytes of the files archive copied so far and its total size.
+func (d *DockerDriver) SetUploadProgress(progress func(copied, total int64)) {
+	d.uploadProgress = progress
+}
+
+// SetContainerStopTimeout sets how long, in seconds, the Docker daemon waits for the container to
+// exit after sending it its stop signal, before killing it, when it stops the container itself,
+// such as when the daemon shuts down.
+func (d *DockerDriver) SetContainerStopTimeout(seconds int) {
+	d.containerStopTimeout = &seconds
+}
+
+// SetShmSize sets the size, in bytes, of /dev/shm in the container.
+//
+// When unset, Docker's default of 64MB is used.
+func (d *DockerDriver) SetShmSize(bytes int64) {
+	d.shmSize = bytes
+}
+
+// SetCaptureChanges makes the driver report the changes the invocation image made to its
+// file system in the result of a run.
+//
+// This is disabled by default, as computing the changes is expensive for large images.
+func (d *DockerDriver) SetCaptureChanges(capture bool) {
+	d.captureChanges = capture
+}
+
+// SetTarDumpPath makes the driver write the archive of the files injected into the container
+// to the given path on the host, in addition to copying it, to help debugging file injection.
+// Nothing is written for operations without files.
+func (d *DockerDriver) SetTarDumpPath(path string) {
+	d.tarDumpPath = path
+}
+
+func (d *DockerDriver) hasLogOptions() bool {
+	return d.logTail != "" || d.logSince > 0
+}
+
+// readableLogDrivers are the logging drivers from which the daemon can read logs back
+var readableLogDrivers = map[string]bool{
+	"":          true,
+	"json-file": true,
+	"local":     true,
+	"journald":  true,
+}
+
+// canReadLogs tells whether the logs of the container can be read back from its logging driver.
+func (d *DockerDriver) canReadLogs() bool {
+	return readableLogDrivers[d.logConfig.Type]
+}
+
+func (d *DockerDriver) logsOptions() types.ContainerLogsOptions {
+	opts := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+		Tail:       d.logTail,
+	}
+	if d.logSince > 0 {
+		opts.Since = d.logSince.String()
+	}
+	return opts
+}
+
+// resolveImage returns the reference an image reference resolves to with the resolver set with
+// SetImageResolver, if any.
+func (d *DockerDriver) resolveImage(ref string) (string, error) {
+	if d.imageResolver == nil {
+		return ref, nil
+	}
+	image, err := d.imageResolver(ref)
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve image %s: %v", ref, err)
+	}
+	return image, nil
+}
+
+// loadLocalImage loads the archive added with AddLocalImage for an image, if any, and tells
+// whether it did.
+func (d *DockerDriver) loadLocalImage(ctx context.Context, cli command.Cli, image string) (bool, error) {
+	// The archive can only be read once, it is taken out of the driver, which concurrent runs share.
+	d.localImagesMu.Lock()
+	r, ok := d.localImages[image]
+	delete(d.localImages, image)
+	d.localImagesMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	resp, err := cli.Client().ImageLoad(ctx, r, true)
+	if err != nil {
+		return false, fmt.Errorf("cannot load image %s: %v", image, err)
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	} else {
+		err = jsonmessage.DisplayJSONMessagesStream(resp.Body, ioutil.Discard, 0, false, nil)
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot load image %s: %v", image, err)
+	}
+	return true, nil
+}
+
+// pullImage pulls an image, writing the progress of the pull to out.
+func (d *DockerDriver) pullImage(ctx context.Context, cli command.Cli, image string, out io.Writer) error {
 	ref, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
 		return err
@@ -87,7 +952,10 @@ func pullImage(ctx context.Context, cli command.Cli, image string) error {
 	if err != nil {
 		return err
 	}
-	authConfig := command.ResolveAuthConfig(ctx, cli, repoInfo.Index)
+	authConfig, err := d.registryAuth(ctx, cli, repoInfo.Index)
+	if err != nil {
+		return err
+	}
 	encodedAuth, err := command.EncodeAuthToBase64(authConfig)
 	if err != nil {
 		return err
@@ -102,101 +970,553 @@ func pullImage(ctx context.Context, cli command.Cli, image string) error {
 	defer responseBody.Close()
 
 	// passing isTerm = false here because of https://github.com/Nvveen/Gotty/pull/1
-	return jsonmessage.DisplayJSONMessagesStream(responseBody, cli.Out(), cli.Out().FD(), false, nil)
+	return jsonmessage.DisplayJSONMessagesStream(responseBody, out, 0, false, nil)
 }
 
-func (d *DockerDriver) initializeDockerCli() (command.Cli, error) {
-	if d.dockerCli != nil {
-		return d.dockerCli, nil
+// registryAuth returns the credentials of a registry, from the file set with SetDockerConfigJSON
+// or from the configuration of the Docker CLI.
+func (d *DockerDriver) registryAuth(ctx context.Context, cli command.Cli, index *registrytypes.IndexInfo) (types.AuthConfig, error) {
+	if d.dockerConfigJSON == "" {
+		return command.ResolveAuthConfig(ctx, cli, index), nil
 	}
-	cli, err := command.NewDockerCli()
+	f, err := os.Open(d.dockerConfigJSON)
 	if err != nil {
-		return nil, err
-	}
-	if d.config["DOCKER_DRIVER_QUIET"] == "1" {
-		cli.Apply(command.WithCombinedStreams(ioutil.Discard))
+		return types.AuthConfig{}, fmt.Errorf("cannot read docker config %s: %v", d.dockerConfigJSON, err)
 	}
-	if err := cli.Initialize(cliflags.NewClientOptions()); err != nil {
-		return nil, err
+	defer f.Close()
+	config := configfile.New(d.dockerConfigJSON)
+	if err := config.LoadFromReader(f); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("cannot parse docker config %s: %v", d.dockerConfigJSON, err)
 	}
-	d.dockerCli = cli
-	return cli, nil
+	return registry.ResolveAuthConfig(config.AuthConfigs, index), nil
 }
 
-func (d *DockerDriver) exec(op *Operation) error {
-	ctx := context.Background()
-
+// Pull pulls an image without running it, for instance to warm up the image cache ahead of time.
+//
+// Images already available locally are only pulled again when the driver is configured to always pull.
+func (d *DockerDriver) Pull(ctx context.Context, ref string) error {
 	cli, err := d.initializeDockerCli()
 	if err != nil {
 		return err
 	}
+	return d.pull(ctx, cli, ref, cli.Out())
+}
 
-	if d.Simulate {
-		return nil
-	}
-	if d.config["PULL_ALWAYS"] == "1" {
-		if err := pullImage(ctx, cli, op.Image); err != nil {
-			return err
+// pull implements Pull, writing the progress of the pull to out.
+func (d *DockerDriver) pull(ctx context.Context, cli command.Cli, ref string, out io.Writer) error {
+	if d.config["PULL_ALWAYS"] != "1" {
+		_, _, err := cli.Client().ImageInspectWithRaw(ctx, ref)
+		if err == nil {
+			return nil
+		}
+		if !client.IsErrNotFound(err) {
+			return fmt.Errorf("cannot inspect image %s: %v", ref, err)
 		}
 	}
-	var env []string
-	for k, v := range op.Environment {
-		env = append(env, fmt.Sprintf("%s=%v", k, v))
-	}
-
-	cfg := &container.Config{
-		Image:        op.Image,
-		Env:          env,
-		Entrypoint:   strslice.StrSlice{"/cnab/app/run"},
-		AttachStderr: true,
-		AttachStdout: true,
+	if err := d.pullImage(ctx, cli, ref, out); err != nil {
+		return fmt.Errorf("cannot pull image %s: %v", ref, err)
 	}
+	return verifyPulledDigest(ctx, cli, ref)
+}
 
-	hostCfg := &container.HostConfig{AutoRemove: true}
+// defaultMaxConcurrentPulls bounds the number of images PullBundleImages pulls at once unless
+// SetMaxConcurrentPulls is called
+const defaultMaxConcurrentPulls = 3
 
-	for _, opt := range d.dockerConfigurationOptions {
-		if err := opt(cfg, hostCfg); err != nil {
-			return err
-		}
+// PullBundleImages pulls the images of a bundle, such as its invocation images and the images of
+// its components, concurrently, like Pull does for each of them.
+//
+// References are resolved, and images added with AddLocalImage are loaded instead of pulled, as
+// when running an operation. The progress of each pull is written at once, when it is over, so
+// that the output of concurrent pulls is not interleaved.
+//
+// Every image is attempted even when some fail. The returned error, if any, is a *PullError
+// holding the error of each image that could not be pulled, or the error of ctx when it is done
+// before every pull is started.
+func (d *DockerDriver) PullBundleImages(ctx context.Context, refs []string) error {
+	// The client is shared by the pulls, it is initialized once beforehand.
+	cli, err := d.initializeDockerCli()
+	if err != nil {
+		return err
 	}
-
-	resp, err := cli.Client().ContainerCreate(ctx, cfg, hostCfg, nil, "")
-	switch {
-	case client.IsErrNotFound(err):
-		fmt.Fprintf(cli.Err(), "Unable to find image '%s' locally\n", op.Image)
-		if err := pullImage(ctx, cli, op.Image); err != nil {
-			return err
+	errs := make([]error, len(refs))
+	limit := d.maxConcurrentPulls
+	if limit < 1 {
+		limit = defaultMaxConcurrentPulls
+	}
+	sem := make(chan struct{}, limit)
+	var (
+		wg    sync.WaitGroup
+		outMu sync.Mutex
+	)
+	for i, ref := range refs {
+		// Local images are loaded one at a time, as loading consumes the archives added with AddLocalImage.
+		image, err := d.resolveImage(ref)
+		if err != nil {
+			errs[i] = err
+			continue
 		}
-		if resp, err = cli.Client().ContainerCreate(ctx, cfg, hostCfg, nil, ""); err != nil {
-			return fmt.Errorf("cannot create container: %v", err)
+		loaded, err := d.loadLocalImage(ctx, cli, image)
+		if err != nil || loaded {
+			errs[i] = err
+			continue
 		}
-	case err != nil:
-		return fmt.Errorf("cannot create container: %v", err)
+		if !acquirePullSlot(ctx, sem) {
+			// The pulls in flight are cancelled with ctx, the remaining ones are not started.
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(i int, image string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var out bytes.Buffer
+			errs[i] = d.pull(ctx, cli, image, &out)
+			outMu.Lock()
+			defer outMu.Unlock()
+			io.Copy(cli.Out(), &out)
+		}(i, image)
+	}
+	wg.Wait()
+
+	pullErr := &PullError{}
+	for _, err := range errs {
+		if err != nil {
+			pullErr.Errors = append(pullErr.Errors, err)
+		}
+	}
+	if len(pullErr.Errors) > 0 {
+		return pullErr
+	}
+	return nil
+}
+
+// acquirePullSlot takes a slot in sem for a pull, unless ctx is done first.
+func acquirePullSlot(ctx context.Context, sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		// A slot may be freed as ctx is done, no pull is started once it is.
+		if ctx.Err() != nil {
+			<-sem
+			return false
+		}
+		return true
+	case <-ctx.Done():
+		return false
 	}
+}
 
-	tarContent, err := generateTar(op.Files)
+// InspectImage returns the metadata of an image, pulling it first if it is not
+// available locally or if the driver is configured to always pull.
+func (d *DockerDriver) InspectImage(ctx context.Context, image string) (types.ImageInspect, error) {
+	cli, err := d.initializeDockerCli()
 	if err != nil {
-		return fmt.Errorf("error staging files: %s", err)
+		return types.ImageInspect{}, err
 	}
-	options := types.CopyToContainerOptions{
-		AllowOverwriteDirWithFile: false,
+
+	if d.config["PULL_ALWAYS"] == "1" {
+		if err := d.pullImage(ctx, cli, image, cli.Out()); err != nil {
+			return types.ImageInspect{}, err
+		}
+	}
+	ii, _, err := cli.Client().ImageInspectWithRaw(ctx, image)
+	switch {
+	case client.IsErrNotFound(err):
+		fmt.Fprintf(cli.Err(), "Unable to find image '%s' locally\n", image)
+		if err := d.pullImage(ctx, cli, image, cli.Out()); err != nil {
+			return types.ImageInspect{}, err
+		}
+		if ii, _, err = cli.Client().ImageInspectWithRaw(ctx, image); err != nil {
+			return types.ImageInspect{}, fmt.Errorf("cannot inspect image %s: %v", image, err)
+		}
+	case err != nil:
+		return types.ImageInspect{}, fmt.Errorf("cannot inspect image %s: %v", image, err)
+	}
+	return ii, nil
+}
+
+func (d *DockerDriver) initializeDockerCli() (command.Cli, error) {
+	if d.dockerCli != nil {
+		return d.dockerCli, nil
 	}
-	// This copies the tar to the root of the container. The tar has been assembled using the
-	// path from the given file, starting at the /.
-	err = cli.Client().CopyToContainer(ctx, resp.ID, "/", tarContent, options)
+	cli, err := command.NewDockerCli()
 	if err != nil {
-		return fmt.Errorf("error copying to / in container: %s", err)
+		return nil, err
+	}
+	if d.config["DOCKER_DRIVER_QUIET"] == "1" {
+		cli.Apply(command.WithCombinedStreams(ioutil.Discard))
+	}
+	if err := cli.Initialize(d.clientOptions()); err != nil {
+		return nil, err
+	}
+	d.dockerCli = cli
+	return cli, nil
+}
+
+func (d *DockerDriver) clientOptions() *cliflags.ClientOptions {
+	opts := cliflags.NewClientOptions()
+	if d.dockerHost != "" {
+		opts.Common.Hosts = []string{d.dockerHost}
+	}
+	opts.Common.Context = d.dockerContext
+	return opts
+}
+
+// environment returns the environment variables of the container.
+func (d *DockerDriver) environment(op *Operation) ([]string, error) {
+	var env, disallowed []string
+	for k, v := range d.traceEnv {
+		if _, ok := op.Environment[k]; !ok {
+			env = append(env, fmt.Sprintf("%s=%v", k, v))
+		}
+	}
+	if d.traceContextInjector != nil && op.Context != nil {
+		headers := map[string]string{}
+		d.traceContextInjector(op.Context, headers)
+		for header, k := range traceContextEnv {
+			if _, ok := op.Environment[k]; !ok && headers[header] != "" {
+				env = append(env, fmt.Sprintf("%s=%v", k, headers[header]))
+			}
+		}
+	}
+	for k, v := range op.Environment {
+		if d.envAllowlist != nil && !d.envAllowlist[k] {
+			disallowed = append(disallowed, k)
+			continue
+		}
+		env = append(env, fmt.Sprintf("%s=%v", k, v))
 	}
+	if len(disallowed) > 0 && d.rejectDisallowedEnv {
+		sort.Strings(disallowed)
+		return nil, fmt.Errorf("environment variables not allowed: %s", strings.Join(disallowed, ", "))
+	}
+	// Variables are sorted by name, so that the configuration of the container is reproducible.
+	sort.SliceStable(env, func(i, j int) bool {
+		return envName(env[i]) < envName(env[j])
+	})
+	return env, nil
+}
+
+// envName returns the name of a NAME=value environment variable.
+func envName(v string) string {
+	return strings.SplitN(v, "=", 2)[0]
+}
 
-	attach, err := cli.Client().ContainerAttach(ctx, resp.ID, types.ContainerAttachOptions{
-		Stream: true,
-		Stdout: true,
-		Stderr: true,
-		Logs:   true,
+// files returns the files to inject into the container, including the run context when enabled.
+func (d *DockerDriver) files(op *Operation) (map[string]string, error) {
+	_, hasResolvConf := op.Files[resolvConfPath]
+	if !d.injectRunContext && !hasResolvConf {
+		return op.Files, nil
+	}
+	files := make(map[string]string, len(op.Files)+1)
+	for path, content := range op.Files {
+		// resolv.conf is applied to the DNS settings of the container rather than copied.
+		if path != resolvConfPath {
+			files[path] = content
+		}
+	}
+	if !d.injectRunContext {
+		return files, nil
+	}
+	rc, err := json.Marshal(RunContext{
+		Action:       op.Action,
+		Installation: op.Installation,
+		Revision:     op.Revision,
+		Timestamp:    time.Now().UTC(),
 	})
 	if err != nil {
-		return fmt.Errorf("unable to retrieve logs: %v", err)
+		return nil, fmt.Errorf("cannot generate run context: %v", err)
+	}
+	if _, ok := op.Files[runContextPath]; ok {
+		return nil, fmt.Errorf("file %s collides with the run context", runContextPath)
+	}
+	files[runContextPath] = string(rc)
+	return files, nil
+}
+
+func (d *DockerDriver) securityOptions() []string {
+	var opts []string
+	if d.seccompProfile != "" {
+		opts = append(opts, "seccomp="+d.seccompProfile)
+	}
+	return opts
+}
+
+func (d *DockerDriver) resources() (container.Resources, error) {
+	if d.memory > 0 && d.memorySwap > 0 && d.memorySwap < d.memory {
+		return container.Resources{}, fmt.Errorf("memory swap limit %d should be greater than or equal to the memory limit %d", d.memorySwap, d.memory)
+	}
+	if d.memory > 0 && d.memoryReservation > d.memory {
+		return container.Resources{}, fmt.Errorf("memory reservation %d should be lower than or equal to the memory limit %d", d.memoryReservation, d.memory)
+	}
+	return container.Resources{
+		CgroupParent:      d.cgroupParent,
+		Memory:            d.memory,
+		MemorySwap:        d.memorySwap,
+		MemorySwappiness:  d.memorySwappiness,
+		MemoryReservation: d.memoryReservation,
+		OomKillDisable:    d.oomKillDisable,
+	}, nil
+}
+
+func (d *DockerDriver) exec(op *Operation, events *eventLog) (OperationResult, error) {
+	ctx := op.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if d.lastRunHash != "" {
+		hash, err := op.Hash()
+		if err != nil {
+			return OperationResult{}, err
+		}
+		if hash == d.lastRunHash {
+			return OperationResult{Unchanged: true}, nil
+		}
+	}
+
+	cli, err := d.initializeDockerCli()
+	if err != nil {
+		return OperationResult{}, err
+	}
+
+	if d.Simulate {
+		return OperationResult{}, nil
+	}
+	if d.imageResolver != nil {
+		image, err := d.resolveImage(op.Image)
+		if err != nil {
+			return OperationResult{}, err
+		}
+		// The operation of the caller is left untouched.
+		resolved := *op
+		resolved.Image = image
+		op = &resolved
+	}
+	if d.requireDigest {
+		if err := requireDigest(op.Image); err != nil {
+			return OperationResult{}, err
+		}
+	}
+	loaded, err := d.loadLocalImage(ctx, cli, op.Image)
+	if err != nil {
+		return OperationResult{}, err
+	}
+	if d.config["PULL_ALWAYS"] == "1" && !loaded {
+		if err := d.pullImage(ctx, cli, op.Image, cli.Out()); err != nil {
+			return OperationResult{}, err
+		}
+	}
+	env, err := d.environment(op)
+	if err != nil {
+		return OperationResult{}, err
+	}
+
+	cfg := &container.Config{
+		Image:        op.Image,
+		Env:          env,
+		Entrypoint:   d.entrypoint(op.ImageType),
+		Cmd:          d.cmd,
+		WorkingDir:   d.workingDir,
+		Hostname:     d.hostname,
+		AttachStderr: true,
+		AttachStdout: true,
+		Labels:       map[string]string{},
+		StopTimeout:  d.containerStopTimeout,
+	}
+	if op.Bundle != nil {
+		for k, v := range BundleLabels(op.Bundle) {
+			cfg.Labels[k] = v
+		}
+	}
+	for k, v := range op.Labels {
+		cfg.Labels[k] = v
+	}
+	cfg.Labels[DriverLabel] = "docker"
+
+	if d.healthcheck != nil {
+		cfg.Healthcheck = d.healthcheck
+	}
+
+	hostCfg := &container.HostConfig{
+		ShmSize:     d.shmSize,
+		Privileged:  d.privileged,
+		Init:        d.init,
+		PidMode:     d.pidMode,
+		Mounts:      d.mounts,
+		SecurityOpt: d.securityOptions(),
+		LogConfig:   d.logConfig,
+		Runtime:     d.runtime,
+		OomScoreAdj: d.oomScoreAdj,
+		Sysctls:     d.sysctls,
+		Isolation:   d.isolation,
+	}
+	if d.hasLogOptions() && !d.canReadLogs() {
+		return OperationResult{}, fmt.Errorf("logs cannot be read from the %s logging driver, log options cannot be used", d.logConfig.Type)
+	}
+	if hostCfg.Resources, err = d.resources(); err != nil {
+		return OperationResult{}, err
+	}
+	if content, ok := op.Files[resolvConfPath]; ok {
+		conf, err := parseResolvConf(content)
+		if err != nil {
+			return OperationResult{}, fmt.Errorf("invalid %s: %v", resolvConfPath, err)
+		}
+		hostCfg.DNS, hostCfg.DNSSearch, hostCfg.DNSOptions = conf.nameservers, conf.search, conf.options
+	}
+	if d.hardened {
+		hostCfg.ReadonlyRootfs = true
+		hostCfg.CapDrop = []string{"ALL"}
+		hostCfg.SecurityOpt = append(hostCfg.SecurityOpt, "no-new-privileges")
+		hostCfg.Mounts = append(hostCfg.Mounts[:len(hostCfg.Mounts):len(hostCfg.Mounts)], mount.Mount{
+			Type:   mount.TypeTmpfs,
+			Target: "/tmp",
+		})
+	}
+	if d.oomKillDisable != nil && *d.oomKillDisable && d.memory == 0 {
+		fmt.Fprintln(cli.Err(), "WARNING: the OOM killer is disabled for a container without a memory limit, it can exhaust the memory of the host")
+	}
+
+	for _, opt := range d.dockerConfigurationOptions {
+		if err := opt(cfg, hostCfg); err != nil {
+			return OperationResult{}, err
+		}
+	}
+	if d.debugShell {
+		cfg.Entrypoint = keepAliveEntrypoint
+		cfg.Cmd = nil
+	}
+	// Files are checked before creating the container, so that files colliding with each
+	// other are reported without any effect on the Docker host.
+	files, err := d.files(op)
+	if err != nil {
+		return OperationResult{}, err
+	}
+	// Docker refuses to copy files into a read-only root file system, except below volumes.
+	var filesRoot string
+	if hostCfg.ReadonlyRootfs {
+		filesRoot = cnabDir
+	}
+	if _, err := tarPaths(files, cfg.WorkingDir, filesRoot); err != nil {
+		return OperationResult{}, fmt.Errorf("error staging files: %s", err)
+	}
+	if hostCfg.ReadonlyRootfs {
+		// The anonymous volume is populated from the image when the container is created, and
+		// keeps the outputs written by the invocation image until the container is removed.
+		hostCfg.Mounts = append(hostCfg.Mounts[:len(hostCfg.Mounts):len(hostCfg.Mounts)], mount.Mount{
+			Type:   mount.TypeVolume,
+			Target: cnabDir,
+		})
+	}
+
+	// With an outputs mount, outputs are written directly to the host. As a bind mount, the
+	// directory must be on the host of the Docker daemon, and writable by the user of the
+	// invocation image.
+	var outputsMount string
+	if base := d.config["OUTPUTS_MOUNT_PATH"]; base != "" && !d.skipOutputs && !d.debugShell {
+		if outputsMount, err = ioutil.TempDir(base, "cnab-outputs-"); err != nil {
+			return OperationResult{}, fmt.Errorf("cannot create outputs directory: %v", err)
+		}
+		defer os.RemoveAll(outputsMount)
+		hostCfg.Mounts = append(hostCfg.Mounts[:len(hostCfg.Mounts):len(hostCfg.Mounts)], mount.Mount{
+			Type:   mount.TypeBind,
+			Source: outputsMount,
+			Target: outputsDir,
+		})
+	}
+
+	if d.verifyRuntime && hostCfg.Runtime != "" {
+		if err := checkRuntime(ctx, cli, hostCfg.Runtime); err != nil {
+			return OperationResult{}, err
+		}
+	}
+	if err := ensureVolumes(ctx, cli, hostCfg.Mounts); err != nil {
+		return OperationResult{}, err
+	}
+
+	// With a post-run command, the container is kept running once the invocation image is done,
+	// and the command of the invocation image is executed in it.
+	postRun := len(d.postRunExec) > 0 && !d.debugShell
+	createCfg := cfg
+	if postRun {
+		keepAlive := *cfg
+		keepAlive.Entrypoint, keepAlive.Cmd = keepAliveEntrypoint, nil
+		createCfg = &keepAlive
+	}
+	var resp container.ContainerCreateCreatedBody
+	create := func() error {
+		resp, err = cli.Client().ContainerCreate(ctx, createCfg, hostCfg, nil, "")
+		return err
+	}
+	pulled := d.config["PULL_ALWAYS"] == "1" && !loaded
+	err = d.startRetryPolicy().do(ctx, create, isTransientCreateError)
+	switch {
+	case client.IsErrNotFound(err):
+		fmt.Fprintf(cli.Err(), "Unable to find image '%s' locally\n", op.Image)
+		pulled = true
+		if err := d.pullImage(ctx, cli, op.Image, cli.Out()); err != nil {
+			return OperationResult{}, err
+		}
+		if err := d.startRetryPolicy().do(ctx, create, isTransientCreateError); err != nil {
+			return OperationResult{}, fmt.Errorf("cannot create container: %v", err)
+		}
+	case err != nil:
+		return OperationResult{}, fmt.Errorf("cannot create container: %v", err)
+	}
+	if !pulled {
+		events.emit(Event{Type: EventImagePullSkipped, Image: op.Image})
+	}
+	// The container is not automatically removed when it exits, so that its file system
+	// can still be inspected once the invocation image is done. It is stopped first when the
+	// operation returns before it is known to have exited.
+	events.emit(Event{Type: EventContainerCreated, ContainerID: resp.ID})
+	if d.onContainerCreated != nil {
+		d.onContainerCreated(resp.ID)
+	}
+	exited, keep := false, false
+	defer func() {
+		if !keep {
+			d.removeContainer(cli, resp.ID, !exited, hostCfg.ReadonlyRootfs, op.Out)
+		}
+	}()
+
+	// The image is known to be available once the container is created, including when it
+	// had to be pulled. It is inspected once for all the checks below.
+	ii, _, err := cli.Client().ImageInspectWithRaw(ctx, op.Image)
+	if err != nil {
+		return OperationResult{}, fmt.Errorf("cannot inspect image %s: %v", op.Image, err)
+	}
+	if err := d.checkArchitecture(ctx, cli, op.Image, ii); err != nil {
+		return OperationResult{}, err
+	}
+	if err := verifyDigest(op.Image, ii); err != nil {
+		return OperationResult{}, err
+	}
+	digest, err := imageDigest(op.Image, ii)
+	if err != nil {
+		return OperationResult{}, err
+	}
+	events.emit(Event{Type: EventImageResolved, Image: op.Image, ImageDigest: digest})
+
+	var manifest *RunManifest
+	if d.runManifest {
+		manifest = newRunManifest(ii, cfg, hostCfg, files, op.FileModes)
 	}
+	// Copying an empty archive would be a useless round-trip to the Docker daemon.
+	if len(files) > 0 {
+		tarOpts := tarOptions{
+			uid:        d.fileUID,
+			gid:        d.fileGID,
+			modTime:    d.fileModTime(),
+			workingDir: cfg.WorkingDir,
+			modes:      op.FileModes,
+			root:       filesRoot,
+		}
+		if err := d.copyFiles(ctx, cli, resp.ID, files, tarOpts); err != nil {
+			return OperationResult{}, err
+		}
+	}
+
 	var (
 		stdout io.Writer = os.Stdout
 		stderr io.Writer = os.Stderr
@@ -207,58 +1527,1102 @@ func (d *DockerDriver) exec(op *Operation) error {
 	if d.containerErr != nil {
 		stderr = d.containerErr
 	}
-	go func() {
-		defer attach.Close()
-		for {
-			_, err := stdcopy.StdCopy(stdout, stderr, attach.Reader)
-			if err != nil {
-				break
-			}
+	if op.ContainerOut != nil {
+		stdout = op.ContainerOut
+	}
+	if op.ContainerErr != nil {
+		stderr = op.ContainerErr
+	}
+	if d.logFile != "" {
+		log, err := openLogFile(d.logFile, d.rotateLogFile)
+		if err != nil {
+			return OperationResult{}, err
 		}
-	}()
+		defer log.Close()
+		stdout = io.MultiWriter(stdout, log)
+		stderr = io.MultiWriter(stderr, log)
+	}
+	// streamed is closed once the output of the container was entirely copied.
+	streamed := make(chan struct{})
+	if !d.hasLogOptions() && !d.debugShell && !postRun {
+		// Replaying the logs fails when they cannot be read back, they are empty anyway as the
+		// container is not started yet.
+		attach, err := cli.Client().ContainerAttach(ctx, resp.ID, types.ContainerAttachOptions{
+			Stream: true,
+			Stdout: true,
+			Stderr: true,
+			Logs:   d.canReadLogs(),
+		})
+		if err != nil {
+			return OperationResult{}, fmt.Errorf("unable to retrieve logs: %v", err)
+		}
+		go func() {
+			defer close(streamed)
+			defer attach.Close()
+			// The attached stream ends when the container exits.
+			stdcopy.StdCopy(stdout, stderr, attach.Reader)
+		}()
+	}
+
+	if d.debugShell {
+		// The container runs until it is removed, it is neither waited for nor cleaned up.
+		err = d.startRetryPolicy().do(ctx, func() error {
+			return cli.Client().ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+		}, isTransientDaemonError)
+		if err != nil {
+			return OperationResult{}, fmt.Errorf("cannot start container: %v", err)
+		}
+		keep = true
+		printDebugShellInstructions(op.Out, resp.ID)
+		return OperationResult{}, nil
+	}
 
-	statusc, errc := cli.Client().ContainerWait(ctx, resp.ID, container.WaitConditionRemoved)
-	if err = cli.Client().ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
-		return fmt.Errorf("cannot start container: %v", err)
+	var waitc <-chan waitResult
+	if !postRun {
+		var cancelWait context.CancelFunc
+		waitc, cancelWait = waitContainer(ctx, cli, resp.ID)
+		defer cancelWait()
 	}
-	select {
-	case err := <-errc:
+	err = d.startRetryPolicy().do(ctx, func() error {
+		return cli.Client().ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	}, isTransientDaemonError)
+	if err != nil {
+		return OperationResult{}, fmt.Errorf("cannot start container: %v", err)
+	}
+	events.emit(Event{Type: EventContainerStarted, ContainerID: resp.ID})
+	if postRun {
+		waitc = execMain(ctx, cli, resp.ID, mainCommand(cfg, ii), stdout, stderr)
+	}
+	if d.hasLogOptions() && !postRun {
+		// Logs are only followed once the container is running, the tail and since bounds
+		// make sure output produced before this point is not lost.
+		logs, err := cli.Client().ContainerLogs(ctx, resp.ID, d.logsOptions())
 		if err != nil {
-			return fmt.Errorf("error in container: %v", err)
+			return OperationResult{}, fmt.Errorf("unable to retrieve logs: %v", err)
 		}
-	case s := <-statusc:
-		if s.StatusCode == 0 {
-			return nil
+		go func() {
+			defer close(streamed)
+			defer logs.Close()
+			stdcopy.StdCopy(stdout, stderr, logs)
+		}()
+	}
+	if d.statsHandler != nil {
+		statsCtx, cancel := context.WithCancel(ctx)
+		stats, err := cli.Client().ContainerStats(statsCtx, resp.ID, true)
+		if err != nil {
+			cancel()
+			return OperationResult{}, fmt.Errorf("unable to retrieve stats: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer stats.Body.Close()
+			streamStats(stats.Body, d.statsHandler)
+		}()
+		// The handler is not called anymore once the run is over.
+		defer func() {
+			cancel()
+			<-done
+		}()
+	}
+	var timeout <-chan time.Time
+	if d.runTimeout > 0 {
+		timer := time.NewTimer(d.runTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var status container.ContainerWaitOKBody
+	select {
+	case res := <-waitc:
+		if res.err != nil {
+			return OperationResult{}, fmt.Errorf("error in container: %v", res.err)
+		}
+		status = res.status
+		// A container kept running for the post-run command is stopped once it is executed.
+		exited = !postRun
+		exitCode := int(status.StatusCode)
+		events.emit(Event{Type: EventContainerExited, ContainerID: resp.ID, ExitCode: &exitCode})
+		if !postRun {
+			// The last lines written by the container may not have been copied yet.
+			d.drainOutput(streamed)
+		}
+	case <-timeout:
+		// A nil timeout lets the daemon wait for its default grace period before killing the container.
+		if err := cli.Client().ContainerStop(ctx, resp.ID, nil); err != nil {
+			return OperationResult{}, fmt.Errorf("container did not exit within %s and could not be stopped: %v", d.runTimeout, err)
+		}
+		exited = true
+		return OperationResult{}, fmt.Errorf("container did not exit within %s", d.runTimeout)
+	case <-ctx.Done():
+		// The container is stopped and removed along with the operation.
+		return OperationResult{}, fmt.Errorf("operation canceled: %v", ctx.Err())
+	}
+	success, exitErr := d.classifyExitCode(int(status.StatusCode))
+
+	if postRun {
+		postRunErr := runExec(ctx, cli, resp.ID, d.postRunExec, stdout, stderr)
+		// The shell keeping the container running holds nothing, it is not given time to stop.
+		noGrace := time.Duration(0)
+		if err := cli.Client().ContainerStop(ctx, resp.ID, &noGrace); err != nil {
+			return OperationResult{}, fmt.Errorf("cannot stop container: %v", err)
+		}
+		exited = true
+		if postRunErr != nil {
+			// The failure of the operation itself is more relevant than the one of its cleanup.
+			if success {
+				return OperationResult{}, fmt.Errorf("post-run command failed: %v", postRunErr)
+			}
+			fmt.Fprintf(stderr, "post-run command failed: %v\n", postRunErr)
 		}
-		if s.Error != nil {
-			return fmt.Errorf("container exit code: %d, message: %v", s.StatusCode, s.Error.Message)
+	}
+
+	result := OperationResult{
+		ExitCode:    int(status.StatusCode),
+		RunManifest: manifest,
+		Action:      op.Action,
+		ImageDigest: digest,
+	}
+	if d.captureChanges {
+		if result.Changes, err = containerChanges(ctx, cli, resp.ID); err != nil {
+			return result, err
+		}
+	}
+
+	if success {
+		switch {
+		case outputsMount != "":
+			result.Outputs, result.OutputStatuses, err = readOutputsDir(outputsMount)
+		case !d.skipOutputs:
+			result.Outputs, result.OutputStatuses, err = fetchOutputs(ctx, cli, resp.ID)
+		default:
+			return result, nil
+		}
+		if err != nil {
+			return result, err
 		}
-		return fmt.Errorf("container exit code: %d", s.StatusCode)
+		events.outputsFetched(result.Outputs)
+		return result, checkDeclaredOutputs(op, result.Outputs)
 	}
-	return err
+	if exitErr != nil {
+		return result, exitErr
+	}
+	msg := fmt.Sprintf("container exit code: %d", status.StatusCode)
+	if status.Error != nil {
+		msg = fmt.Sprintf("container exit code: %d, message: %v", status.StatusCode, status.Error.Message)
+	}
+	if isContainerRuntimeExitCode(status.StatusCode) {
+		return result, containerRuntimeError(msg)
+	}
+	return result, errors.New(msg)
 }
 
-func generateTar(files map[string]string) (io.Reader, error) {
-	r, w := io.Pipe()
-	tw := tar.NewWriter(w)
-	for path := range files {
-		if !unix_path.IsAbs(path) {
-			return nil, fmt.Errorf("destination path %s should be an absolute unix path", path)
+// copyFiles copies the files of an operation into its container.
+func (d *DockerDriver) copyFiles(ctx context.Context, cli command.Cli, containerID string, files map[string]string, tarOpts tarOptions) error {
+	tarContent, err := generateTar(files, tarOpts)
+	if err != nil {
+		return fmt.Errorf("error staging files: %s", err)
+	}
+	if d.uploadProgress != nil {
+		// The paths were validated when generating the archive.
+		total, _ := tarSize(files, tarOpts)
+		tarContent = &progressReader{r: tarContent, total: total, progress: d.uploadProgress}
+	}
+	if d.tarDumpPath != "" {
+		dump, err := os.Create(d.tarDumpPath)
+		if err != nil {
+			return fmt.Errorf("cannot create tar dump %s: %v", d.tarDumpPath, err)
+		}
+		defer dump.Close()
+		tarContent = io.TeeReader(tarContent, dump)
+	}
+	options := types.CopyToContainerOptions{
+		AllowOverwriteDirWithFile: d.allowOverwriteDirWithFile,
+	}
+	// This copies the tar to the root of the container, or to the root of the files. The tar has
+	// been assembled using the path from the given file, relative to that root.
+	dest := "/"
+	if tarOpts.root != "" {
+		dest = tarOpts.root
+	}
+	err = cli.Client().CopyToContainer(ctx, containerID, dest, tarContent, options)
+	if err != nil {
+		return fmt.Errorf("error copying to %s in container: %s", dest, err)
+	}
+	return nil
+}
+
+// printDebugShellInstructions explains how to debug the invocation image in a container started
+// with a debug shell.
+func printDebugShellInstructions(out io.Writer, containerID string) {
+	if out == nil {
+		out = os.Stdout
+	}
+	fmt.Fprintf(out, "The container %s is kept running for debugging. To open a shell in it, run:\n", containerID)
+	fmt.Fprintf(out, "  docker exec -it %s /bin/sh\n", containerID)
+	fmt.Fprintf(out, "The operation can be run in it with /cnab/app/run. Once done, remove the container with:\n")
+	fmt.Fprintf(out, "  docker rm -f %s\n", containerID)
+}
+
+// removeContainer removes the container of an operation that is over, stopping it first when it
+// may still be running, along with its anonymous volumes when removeVolumes is set. Failures are
+// reported to the remove error handler, or written to out.
+//
+// The container is cleaned up even when the context of the operation is done.
+func (d *DockerDriver) removeContainer(cli command.Cli, containerID string, mayBeRunning, removeVolumes bool, out io.Writer) {
+	ctx := context.Background()
+	if mayBeRunning {
+		timeout := defaultCleanupStopTimeout
+		if d.removeGrace > 0 {
+			timeout = d.removeGrace
+		}
+		// Stopping a container that is not running, or not started yet, does nothing.
+		if err := cli.Client().ContainerStop(ctx, containerID, &timeout); err != nil && !client.IsErrNotFound(err) {
+			d.removeFailed(containerID, fmt.Errorf("cannot stop container: %v", err), out)
 		}
 	}
+	err := cli.Client().ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{Force: d.forceRemove, RemoveVolumes: removeVolumes})
+	if err != nil && !client.IsErrNotFound(err) {
+		d.removeFailed(containerID, err, out)
+	}
+}
+
+func (d *DockerDriver) removeFailed(containerID string, err error, out io.Writer) {
+	switch {
+	case d.removeErrorHandler != nil:
+		d.removeErrorHandler(containerID, err)
+	case out != nil:
+		fmt.Fprintf(out, "cannot remove container %s: %v\n", containerID, err)
+	}
+}
+
+// waitResult is the outcome of waiting for a container to exit.
+type waitResult struct {
+	status container.ContainerWaitOKBody
+	err    error
+}
+
+// waitContainer waits for a container to stop running and delivers the outcome on the returned
+// channel, which is buffered so that nothing blocks if the outcome is never received.
+//
+// Calling cancel abandons the wait. The channels of the Docker client are still drained, so its
+// goroutine does not leak when the caller returns early.
+func waitContainer(ctx context.Context, cli command.Cli, containerID string) (<-chan waitResult, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	statusc, errc := cli.Client().ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
+	waitc := make(chan waitResult, 1)
 	go func() {
-		for path, content := range files {
-			hdr := &tar.Header{
-				Name: path,
-				Mode: 0644,
-				Size: int64(len(content)),
+		waitc <- receiveWait(statusc, errc)
+	}()
+	return waitc, cancel
+}
+
+// receiveWait receives the outcome of ContainerWait. A nil error, or a closed channel, is not an
+// outcome, and an error delivered along with the status takes precedence over it.
+func receiveWait(statusc <-chan container.ContainerWaitOKBody, errc <-chan error) waitResult {
+	for statusc != nil || errc != nil {
+		select {
+		case status, ok := <-statusc:
+			if !ok {
+				statusc = nil
+				continue
+			}
+			select {
+			case err := <-errc:
+				if err != nil {
+					return waitResult{err: err}
+				}
+			default:
+			}
+			return waitResult{status: status}
+		case err, ok := <-errc:
+			if !ok || err == nil {
+				errc = nil
+				continue
 			}
-			tw.WriteHeader(hdr)
-			tw.Write([]byte(content))
+			return waitResult{err: err}
 		}
-		w.Close()
-	}()
-	return r, nil
+	}
+	return waitResult{err: errors.New("container wait ended without an exit status")}
+}
+
+// runExec executes cmd in a container, writing its output to stdout and stderr.
+func runExec(ctx context.Context, cli command.Cli, containerID string, cmd []string, stdout, stderr io.Writer) error {
+	exitCode, err := execCommand(ctx, cli, containerID, cmd, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exit code: %d", exitCode)
+	}
+	return nil
+}
+
+// execCommand executes a command in a running container and returns its exit code.
+func execCommand(ctx context.Context, cli command.Cli, containerID string, cmd []string, stdout, stderr io.Writer) (int, error) {
+	exec, err := cli.Client().ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot create exec: %v", err)
+	}
+	attach, err := cli.Client().ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return 0, fmt.Errorf("cannot start exec: %v", err)
+	}
+	defer attach.Close()
+	if _, err := stdcopy.StdCopy(stdout, stderr, attach.Reader); err != nil {
+		return 0, fmt.Errorf("cannot read exec output: %v", err)
+	}
+	inspect, err := cli.Client().ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return 0, fmt.Errorf("cannot inspect exec: %v", err)
+	}
+	return inspect.ExitCode, nil
+}
+
+// execMain executes the command of the invocation image in a container kept running, and delivers
+// its exit code on the returned channel, like waitContainer does for the main process of a container.
+func execMain(ctx context.Context, cli command.Cli, containerID string, cmd []string, stdout, stderr io.Writer) <-chan waitResult {
+	waitc := make(chan waitResult, 1)
+	go func() {
+		exitCode, err := execCommand(ctx, cli, containerID, cmd, stdout, stderr)
+		waitc <- waitResult{status: container.ContainerWaitOKBody{StatusCode: int64(exitCode)}, err: err}
+	}()
+	return waitc
+}
+
+// mainCommand returns the command run by a container created with cfg, from an image inspected as
+// ii: its entrypoint followed by its arguments, falling back to those of the image like Docker does.
+func mainCommand(cfg *container.Config, ii types.ImageInspect) []string {
+	entrypoint, args := cfg.Entrypoint, cfg.Cmd
+	if len(entrypoint) == 0 && ii.Config != nil {
+		entrypoint = ii.Config.Entrypoint
+		if len(args) == 0 {
+			args = ii.Config.Cmd
+		}
+	}
+	cmd := make([]string, 0, len(entrypoint)+len(args))
+	cmd = append(cmd, entrypoint...)
+	return append(cmd, args...)
+}
+
+// checkArchitecture fails when image, inspected as ii, is built for another architecture than the
+// expected one, which would otherwise only surface as an "exec format error" from the container.
+//
+// When the architecture of the Docker host cannot be retrieved, it is unknown and nothing is checked.
+func (d *DockerDriver) checkArchitecture(ctx context.Context, cli command.Cli, image string, ii types.ImageInspect) error {
+	expected := d.architecture
+	if expected == "" {
+		if info, err := cli.Client().Info(ctx); err == nil {
+			expected = normalizeArchitecture(info.Architecture)
+		}
+	}
+	if expected == "" {
+		return nil
+	}
+	if ii.Architecture != "" && normalizeArchitecture(ii.Architecture) != expected {
+		return fmt.Errorf("image %s is built for the %s architecture and cannot run on %s", image, ii.Architecture, expected)
+	}
+	return nil
+}
+
+// checkRuntime checks that an OCI runtime is registered with the Docker daemon.
+func checkRuntime(ctx context.Context, cli command.Cli, runtime string) error {
+	info, err := cli.Client().Info(ctx)
+	if err != nil {
+		return fmt.Errorf("cannot retrieve the runtimes of the Docker host: %v", err)
+	}
+	if _, ok := info.Runtimes[runtime]; !ok {
+		names := make([]string, 0, len(info.Runtimes))
+		for name := range info.Runtimes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("runtime %s is not registered with the Docker daemon, available runtimes: %s", runtime, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// requireDigest checks that an image is referenced by digest.
+func requireDigest(image string) error {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %v", image, err)
+	}
+	if _, ok := ref.(reference.Canonical); !ok {
+		return fmt.Errorf("image %s should be referenced by digest", image)
+	}
+	return nil
+}
+
+// verifyPulledDigest checks the digest of an image that was just pulled, see verifyDigest.
+// The image is only inspected for references by digest.
+func verifyPulledDigest(ctx context.Context, cli command.Cli, image string) error {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %v", image, err)
+	}
+	if _, ok := ref.(reference.Canonical); !ok {
+		return nil
+	}
+	ii, _, err := cli.Client().ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return fmt.Errorf("cannot inspect image %s: %v", image, err)
+	}
+	return verifyDigest(image, ii)
+}
+
+// verifyDigest checks that the local image of a reference by digest, inspected as ii, has that
+// digest, among the digests it is known by in its repository. References by tag are not checked.
+func verifyDigest(image string, ii types.ImageInspect) error {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %v", image, err)
+	}
+	canonical, ok := ref.(reference.Canonical)
+	if !ok {
+		return nil
+	}
+	for _, repoDigest := range ii.RepoDigests {
+		rd, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if c, ok := rd.(reference.Canonical); ok && c.Name() == canonical.Name() && c.Digest() == canonical.Digest() {
+			return nil
+		}
+	}
+	return fmt.Errorf("image %s does not match its digest, its digests are: %s", image, strings.Join(ii.RepoDigests, ", "))
+}
+
+// imageDigest returns the digest of an image, inspected as ii, in the repository it is referenced
+// from, or the identifier of the image when it was not pulled from that repository.
+func imageDigest(image string, ii types.ImageInspect) (string, error) {
+	ref, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %s: %v", image, err)
+	}
+	for _, repoDigest := range ii.RepoDigests {
+		rd, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if c, ok := rd.(reference.Canonical); ok && c.Name() == ref.Name() {
+			return c.Digest().String(), nil
+		}
+	}
+	return ii.ID, nil
+}
+
+// normalizeArchitecture converts the architecture reported by the kernel of the Docker host,
+// such as x86_64, to the name used by images, such as amd64.
+func normalizeArchitecture(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "i386", "i686":
+		return "386"
+	case "armv6l", "armv7l":
+		return "arm"
+	}
+	return arch
+}
+
+// ensureVolumes creates the named volumes mounted in the container that do not exist yet.
+func ensureVolumes(ctx context.Context, cli command.Cli, mounts []mount.Mount) error {
+	for _, m := range mounts {
+		// Anonymous volumes are created along with the container.
+		if m.Type != mount.TypeVolume || m.Source == "" {
+			continue
+		}
+		_, err := cli.Client().VolumeInspect(ctx, m.Source)
+		switch {
+		case client.IsErrNotFound(err):
+			if _, err := cli.Client().VolumeCreate(ctx, volumetypes.VolumeCreateBody{Name: m.Source}); err != nil {
+				return fmt.Errorf("cannot create volume %s: %v", m.Source, err)
+			}
+		case err != nil:
+			return fmt.Errorf("cannot inspect volume %s: %v", m.Source, err)
+		}
+	}
+	return nil
+}
+
+// containerChanges lists the changes made to the file system of a container.
+func containerChanges(ctx context.Context, cli command.Cli, containerID string) ([]FileChange, error) {
+	diff, err := cli.Client().ContainerDiff(ctx, containerID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve container changes: %v", err)
+	}
+	changes := make([]FileChange, len(diff))
+	for i, c := range diff {
+		changes[i] = FileChange{Path: c.Path}
+		switch archive.ChangeType(c.Kind) {
+		case archive.ChangeAdd:
+			changes[i].Kind = FileAdded
+		case archive.ChangeModify:
+			changes[i].Kind = FileChanged
+		case archive.ChangeDelete:
+			changes[i].Kind = FileDeleted
+		}
+	}
+	return changes, nil
+}
+
+// PruneContainers removes the containers created by the Docker driver that are not running and
+// were created more than olderThan ago, such as containers left behind by a crashed process.
+// It returns the IDs of the removed containers.
+func (d *DockerDriver) PruneContainers(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	cli, err := d.initializeDockerCli()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := cli.Client().ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", DriverLabel)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list containers: %v", err)
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var removed []string
+	for _, c := range containers {
+		if c.State == "running" || !time.Unix(c.Created, 0).Before(cutoff) {
+			continue
+		}
+		if err := cli.Client().ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{}); err != nil {
+			return removed, fmt.Errorf("cannot remove container %s: %v", c.ID, err)
+		}
+		removed = append(removed, c.ID)
+	}
+	return removed, nil
+}
+
+// fetchOutputs reads the outputs written by a container to /cnab/app/outputs, keyed by their path
+// in the container. A container that wrote no outputs directory has no outputs.
+//
+// When /cnab/app/outputs is a regular file rather than a directory, it is returned as the only output.
+func fetchOutputs(ctx context.Context, cli command.Cli, containerID string) (map[string]string, map[string]OutputStatus, error) {
+	var tarContent io.ReadCloser
+	copyOutputs := func() error {
+		var err error
+		tarContent, _, err = cli.Client().CopyFromContainer(ctx, containerID, outputsDir)
+		return err
+	}
+	// A missing outputs directory is not transient, so it is reported right away
+	err := fetchOutputsRetry.do(ctx, copyOutputs, isTransientDaemonError)
+	if client.IsErrNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error copying outputs from container: %s", err)
+	}
+	defer tarContent.Close()
+	return readOutputs(tarContent)
+}
+
+// checkDeclaredOutputs checks that the outputs declared by the bundle of the operation for its
+// action were all produced.
+func checkDeclaredOutputs(op *Operation, outputs map[string]string) error {
+	if op.Bundle == nil {
+		return nil
+	}
+	var missing []string
+	for name, def := range op.Bundle.Outputs {
+		if _, ok := outputs[def.Path]; !ok && def.AppliesTo(op.Action) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("outputs declared by the bundle were not produced: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// readOutputsDir reads the content of the files of a host directory mounted as the outputs
+// directory. Symbolic links are not followed, as they would resolve on the host.
+//
+// Files that cannot be read are reported as failed, and the other files are still read. The
+// error returned is the one of the first failure.
+func readOutputsDir(dir string) (map[string]string, map[string]OutputStatus, error) {
+	outputs := map[string]string{}
+	statuses := map[string]OutputStatus{}
+	var firstErr error
+	fail := func(path string, err error) {
+		statuses[path] = OutputStatus{Status: OutputFailed, Error: err.Error()}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("error reading output %s: %s", path, err)
+		}
+	}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(dir, path)
+		if relErr != nil {
+			return relErr
+		}
+		pathInContainer := unix_path.Join(outputsDir, filepath.ToSlash(rel))
+		switch {
+		case err != nil && path == dir:
+			return err
+		case err != nil:
+			fail(pathInContainer, err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			fail(pathInContainer, err)
+			return nil
+		}
+		outputs[pathInContainer] = string(content)
+		statuses[pathInContainer] = OutputStatus{Status: OutputFetched}
+		return nil
+	})
+	if err != nil {
+		return outputs, statuses, fmt.Errorf("error reading outputs: %s", err)
+	}
+	return outputs, statuses, firstErr
+}
+
+// readOutputs reads the content of the files of an outputs archive, as returned by CopyFromContainer.
+//
+// The archive cannot be read past a file that failed to be read, that file is reported as failed
+// and the files read until then as fetched.
+func readOutputs(r io.Reader) (map[string]string, map[string]OutputStatus, error) {
+	outputs := map[string]string{}
+	statuses := map[string]OutputStatus{}
+	// The archive is buffered to avoid many small reads of the stream for archives of small files,
+	// and a single buffer is reused to read the content of every file.
+	tr := tar.NewReader(bufio.NewReaderSize(r, outputsBufferSize))
+	var buf bytes.Buffer
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return outputs, statuses, fmt.Errorf("error reading outputs: %s", err)
+		}
+		// Directories are skipped, only the content of files is gathered.
+		if header.FileInfo().IsDir() {
+			continue
+		}
+		pathInContainer, err := outputPath(header.Name)
+		if err != nil {
+			return outputs, statuses, err
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(tr); err != nil {
+			statuses[pathInContainer] = OutputStatus{Status: OutputFailed, Error: err.Error()}
+			return outputs, statuses, fmt.Errorf("error reading output %s: %s", pathInContainer, err)
+		}
+		outputs[pathInContainer] = buf.String()
+		statuses[pathInContainer] = OutputStatus{Status: OutputFetched}
+	}
+	return outputs, statuses, nil
+}
+
+// ListOutputs returns the path, size and mode of the outputs written by a container to /cnab/app/outputs,
+// without retrieving their content.
+func (d *DockerDriver) ListOutputs(ctx context.Context, containerID string) ([]OutputInfo, error) {
+	cli, err := d.initializeDockerCli()
+	if err != nil {
+		return nil, err
+	}
+	tarContent, _, err := cli.Client().CopyFromContainer(ctx, containerID, outputsDir)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error copying outputs from container: %s", err)
+	}
+	defer tarContent.Close()
+
+	var infos []OutputInfo
+	tr := tar.NewReader(tarContent)
+	for {
+		// The content of the previous entry is skipped by Next, without being kept.
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return infos, fmt.Errorf("error reading outputs: %s", err)
+		}
+		if header.FileInfo().IsDir() {
+			continue
+		}
+		path, err := outputPath(header.Name)
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, OutputInfo{
+			Path: path,
+			Size: header.Size,
+			Mode: header.FileInfo().Mode(),
+		})
+	}
+	return infos, nil
+}
+
+// FetchOutputsToDir extracts the outputs written by a container to /cnab/app/outputs into destDir
+// on the host, and returns the paths of the files it wrote. A container that wrote no outputs
+// directory has no outputs, and nothing is written.
+//
+// The directory structure below /cnab/app/outputs is preserved. When /cnab/app/outputs is a regular
+// file rather than a directory, it is written as destDir/outputs. Entries that would be written
+// outside of destDir are rejected.
+//
+// The outputs are extracted to a temporary directory next to destDir, and only moved into destDir
+// once they all are. Each output replaces the file of the same path in destDir, if any, and the
+// other files of destDir are kept. When any step fails, destDir is left as it was.
+func (d *DockerDriver) FetchOutputsToDir(ctx context.Context, containerID, destDir string) ([]string, error) {
+	cli, err := d.initializeDockerCli()
+	if err != nil {
+		return nil, err
+	}
+	tarContent, _, err := cli.Client().CopyFromContainer(ctx, containerID, outputsDir)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error copying outputs from container: %s", err)
+	}
+	defer tarContent.Close()
+
+	destDir = filepath.Clean(destDir)
+	// The temporary directory is on the same file system as destDir, so that outputs are moved
+	// by renaming them.
+	tmpDir, err := ioutil.TempDir(filepath.Dir(destDir), "."+filepath.Base(destDir)+"-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary outputs directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	extractDir := filepath.Join(tmpDir, "outputs")
+	extracted, err := extractOutputs(tarContent, extractDir)
+	if err != nil {
+		return nil, err
+	}
+	written, err := moveOutputs(extractDir, extracted, destDir, filepath.Join(tmpDir, "previous"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot move outputs to %s: %v", destDir, err)
+	}
+	return written, nil
+}
+
+// moveOutputs moves the files extracted to srcDir to the same paths below destDir, and returns
+// their new paths. The files they replace are moved to backupDir, and restored when any file
+// cannot be moved, along with the directories created in destDir.
+func moveOutputs(srcDir string, files []string, destDir, backupDir string) ([]string, error) {
+	// moved records, in order, the outputs moved to their target and the file each replaced, if any.
+	type movedOutput struct {
+		target, backup string
+	}
+	var (
+		moved   []movedOutput
+		created []string
+	)
+	rollback := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			if moved[i].backup != "" {
+				renameOutput(moved[i].backup, moved[i].target)
+			} else {
+				os.Remove(moved[i].target)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			os.RemoveAll(created[i])
+		}
+	}
+	written := make([]string, 0, len(files))
+	for _, path := range files {
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		target := filepath.Join(destDir, rel)
+		if dir := firstMissingDir(filepath.Dir(target)); dir != "" {
+			created = append(created, dir)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			rollback()
+			return nil, err
+		}
+		m := movedOutput{target: target}
+		info, err := os.Lstat(target)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			rollback()
+			return nil, err
+		case info.IsDir():
+			rollback()
+			return nil, fmt.Errorf("output %s would replace a directory", target)
+		default:
+			m.backup = filepath.Join(backupDir, rel)
+			if err := os.MkdirAll(filepath.Dir(m.backup), 0700); err != nil {
+				rollback()
+				return nil, err
+			}
+			if err := renameOutput(target, m.backup); err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+		moved = append(moved, m)
+		if err := renameOutput(path, target); err != nil {
+			rollback()
+			return nil, err
+		}
+		written = append(written, target)
+	}
+	return written, nil
+}
+
+// firstMissingDir returns the topmost directory of dir, or dir itself, that does not exist yet,
+// or an empty string when dir exists.
+func firstMissingDir(dir string) string {
+	missing := ""
+	for {
+		if _, err := os.Lstat(dir); !os.IsNotExist(err) {
+			return missing
+		}
+		missing = dir
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return missing
+		}
+		dir = parent
+	}
+}
+
+// extractOutputs writes the files of an outputs archive, as returned by CopyFromContainer, to destDir.
+func extractOutputs(r io.Reader, destDir string) ([]string, error) {
+	var written []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return written, fmt.Errorf("error reading outputs: %s", err)
+		}
+		name, err := outputName(header.Name)
+		if err != nil {
+			return written, err
+		}
+		if name == "" {
+			if header.FileInfo().IsDir() {
+				continue
+			}
+			// The outputs directory is a regular file, the archive only holds that file.
+			name = unix_path.Base(outputsDir)
+		}
+		target := filepath.Join(destDir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return written, err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return written, err
+			}
+			if err := writeOutputFile(target, header.FileInfo().Mode().Perm(), tr); err != nil {
+				return written, err
+			}
+			written = append(written, target)
+		}
+	}
+	return written, nil
+}
+
+// outputName returns the path of an outputs archive entry relative to the outputs directory.
+//
+// The archive is rooted at the outputs directory itself, so its entries are named "outputs/...".
+// An empty name is returned for the outputs directory, and an error for entries escaping it.
+func outputName(entry string) (string, error) {
+	i := strings.Index(entry, "/")
+	if i < 0 {
+		return "", nil
+	}
+	name := unix_path.Clean(entry[i+1:])
+	if name == "." {
+		return "", nil
+	}
+	if unix_path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", unsafeOutputPathError{entry: entry}
+	}
+	return name, nil
+}
+
+// outputPath returns the path in the container of an outputs archive entry, as returned by CopyFromContainer.
+//
+// The archive is rooted at the outputs directory, or is the outputs file itself, so entries are
+// named relative to /cnab/app. Entries escaping the outputs directory are rejected.
+func outputPath(entry string) (string, error) {
+	path := unix_path.Join(unix_path.Dir(outputsDir), entry)
+	if path != outputsDir && !strings.HasPrefix(path, outputsDir+"/") {
+		return "", unsafeOutputPathError{entry: entry}
+	}
+	return path, nil
+}
+
+func writeOutputFile(path string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tarOptions customizes the headers of the files archive copied into the container
+type tarOptions struct {
+	uid int
+	gid int
+	// modTime is the modification time set on all the files
+	modTime time.Time
+	// workingDir is the directory relative paths are resolved against. When empty, relative paths are rejected.
+	workingDir string
+	// modes are the modes of the files whose mode is not the default 0644, by path
+	modes map[string]os.FileMode
+	// root is the directory the archive is copied to, below which all the files must be. When
+	// empty, the archive is copied to /.
+	root string
+}
+
+func generateTar(files map[string]string, opts tarOptions) (io.Reader, error) {
+	paths, err := tarPaths(files, opts.workingDir, opts.root)
+	if err != nil {
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		writeTar(w, files, paths, opts)
+		w.Close()
+	}()
+	return r, nil
+}
+
+// tarSize returns the size of the files archive generated by generateTar.
+func tarSize(files map[string]string, opts tarOptions) (int64, error) {
+	paths, err := tarPaths(files, opts.workingDir, opts.root)
+	if err != nil {
+		return 0, err
+	}
+	w := &countingWriter{}
+	writeTar(w, files, paths, opts)
+	return w.n, nil
+}
+
+// tarPaths returns the absolute path of each file in the container. When root is set, files
+// outside of it are an error.
+//
+// Two files resolving to the same path, such as /cnab/app/config and config when the working
+// directory is /cnab/app, are an error, as one would silently overwrite the other.
+func tarPaths(files map[string]string, workingDir, root string) (map[string]string, error) {
+	paths := make(map[string]string, len(files))
+	sources := make(map[string]string, len(files))
+	// Paths are resolved in order, so that collisions are reported deterministically.
+	names := make([]string, 0, len(files))
+	for path := range files {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+	for _, path := range names {
+		switch {
+		case unix_path.IsAbs(path):
+			paths[path] = unix_path.Clean(path)
+		case workingDir != "":
+			paths[path] = unix_path.Join(workingDir, path)
+		default:
+			return nil, fmt.Errorf("destination path %s should be an absolute unix path", path)
+		}
+		if root != "" && !strings.HasPrefix(paths[path], root+"/") {
+			return nil, fmt.Errorf("file %s cannot be copied into a read-only root file system, only files below %s can", path, root)
+		}
+		if other, ok := sources[paths[path]]; ok {
+			return nil, fmt.Errorf("files %s and %s are both injected at %s", other, path, paths[path])
+		}
+		sources[paths[path]] = path
+	}
+	return paths, nil
+}
+
+func writeTar(w io.Writer, files, paths map[string]string, opts tarOptions) {
+	// Files are written in order, so that the same files always produce the same archive.
+	names := make([]string, 0, len(files))
+	for path := range files {
+		names = append(names, path)
+	}
+	sort.Strings(names)
+	tw := tar.NewWriter(w)
+	for _, path := range names {
+		content := files[path]
+		mode, ok := opts.modes[path]
+		if !ok {
+			mode = 0644
+		}
+		name := paths[path]
+		if opts.root != "" {
+			name = strings.TrimPrefix(name, opts.root+"/")
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(mode.Perm()),
+			Size:    int64(len(content)),
+			Uid:     opts.uid,
+			Gid:     opts.gid,
+			ModTime: opts.modTime,
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte(content))
+	}
+	// Closing the tar writer pads the last entry and writes the end of the archive,
+	// so that the archive is also valid when dumped to disk.
+	tw.Close()
+}
+
+// countingWriter discards what is written to it, counting the bytes.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// progressReader reports the bytes read from r, out of total, to progress.
+type progressReader struct {
+	r        io.Reader
+	copied   int64
+	total    int64
+	progress func(copied, total int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.copied += int64(n)
+		p.progress(p.copied, p.total)
+	}
+	return n, err
 }
 
 // DockerConfigurationOption is an option used to customize docker driver container and host config
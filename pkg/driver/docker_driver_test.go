@@ -0,0 +1,3886 @@
+package driver
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/streams"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/strslice"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+// fakeCli is a command.Cli that hands out a fakeClient instead of talking to a daemon.
+type fakeCli struct {
+	command.Cli
+	client *fakeClient
+	// out receives the standard output of the CLI, which is discarded when nil
+	out io.Writer
+}
+
+func (c *fakeCli) Client() client.APIClient {
+	return c.client
+}
+
+func (c *fakeCli) Out() *streams.Out {
+	if c.out != nil {
+		return streams.NewOut(c.out)
+	}
+	return streams.NewOut(ioutil.Discard)
+}
+
+func (c *fakeCli) Err() io.Writer {
+	return ioutil.Discard
+}
+
+func (c *fakeCli) ConfigFile() *configfile.ConfigFile {
+	return configfile.New("")
+}
+
+// fakeClient is a client.APIClient whose methods are backed by optional functions.
+//
+// Calling a method whose function is not set panics, which makes unexpected calls obvious.
+type fakeClient struct {
+	client.APIClient
+	imageInspectFunc      func(image string) (types.ImageInspect, []byte, error)
+	imagePullFunc         func(ref string, options types.ImagePullOptions) (io.ReadCloser, error)
+	containerCreateFunc   func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error)
+	copyToContainerFunc   func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error
+	containerAttachFunc   func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error)
+	containerLogsFunc     func(containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	containerWaitFunc     func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error)
+	containerStartFunc    func(containerID string, options types.ContainerStartOptions) error
+	copyFromContainerFunc func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error)
+	containerRemoveFunc   func(containerID string, options types.ContainerRemoveOptions) error
+	containerDiffFunc     func(containerID string) ([]container.ContainerChangeResponseItem, error)
+	containerListFunc     func(options types.ContainerListOptions) ([]types.Container, error)
+	volumeInspectFunc     func(volumeID string) (types.Volume, error)
+	volumeCreateFunc      func(options volumetypes.VolumeCreateBody) (types.Volume, error)
+	containerStopFunc     func(containerID string, timeout *time.Duration) error
+	execCreateFunc        func(containerID string, config types.ExecConfig) (types.IDResponse, error)
+	execAttachFunc        func(execID string, config types.ExecStartCheck) (types.HijackedResponse, error)
+	execInspectFunc       func(execID string) (types.ContainerExecInspect, error)
+	containerStatsFunc    func(containerID string, stream bool) (types.ContainerStats, error)
+	imageLoadFunc         func(input io.Reader, quiet bool) (types.ImageLoadResponse, error)
+	info                  types.Info
+	infoErr               error
+}
+
+// newRunFakeClient returns a fakeClient on which a run succeeds with exit code 0.
+func newRunFakeClient() *fakeClient {
+	return &fakeClient{
+		containerCreateFunc: func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+			return container.ContainerCreateCreatedBody{ID: "test-container"}, nil
+		},
+		copyToContainerFunc: func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+			_, err := io.Copy(ioutil.Discard, content)
+			return err
+		},
+		containerAttachFunc: func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+			// The container writes nothing, so the attached stream ends right away.
+			conn, _ := net.Pipe()
+			return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(strings.NewReader(""))}, nil
+		},
+		containerLogsFunc: func(containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader("")), nil
+		},
+		containerWaitFunc: func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+			statusc := make(chan container.ContainerWaitOKBody, 1)
+			statusc <- container.ContainerWaitOKBody{StatusCode: 0}
+			return statusc, make(chan error)
+		},
+		containerStartFunc: func(containerID string, options types.ContainerStartOptions) error {
+			return nil
+		},
+		containerRemoveFunc: func(containerID string, options types.ContainerRemoveOptions) error {
+			return nil
+		},
+		containerStopFunc: func(containerID string, timeout *time.Duration) error {
+			return nil
+		},
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			return nil, types.ContainerPathStat{}, notFoundError("Could not find the file /cnab/app/outputs in container " + containerID)
+		},
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{ID: "sha256:4bf92f3577b34da6a3ce929d0e0e4736"}, nil, nil
+		},
+	}
+}
+
+func (c *fakeClient) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	return c.imageInspectFunc(image)
+}
+
+func (c *fakeClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return c.imagePullFunc(ref, options)
+}
+
+func (c *fakeClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, containerName string) (container.ContainerCreateCreatedBody, error) {
+	return c.containerCreateFunc(config, hostConfig)
+}
+
+func (c *fakeClient) CopyToContainer(ctx context.Context, containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+	return c.copyToContainerFunc(containerID, dstPath, content, options)
+}
+
+func (c *fakeClient) ContainerAttach(ctx context.Context, containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	return c.containerAttachFunc(containerID, options)
+}
+
+func (c *fakeClient) ContainerLogs(ctx context.Context, containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	return c.containerLogsFunc(containerID, options)
+}
+
+func (c *fakeClient) ContainerWait(ctx context.Context, containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+	return c.containerWaitFunc(containerID, condition)
+}
+
+func (c *fakeClient) ContainerStart(ctx context.Context, containerID string, options types.ContainerStartOptions) error {
+	return c.containerStartFunc(containerID, options)
+}
+
+func (c *fakeClient) CopyFromContainer(ctx context.Context, containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	return c.copyFromContainerFunc(containerID, srcPath)
+}
+
+func (c *fakeClient) ContainerRemove(ctx context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	return c.containerRemoveFunc(containerID, options)
+}
+
+func (c *fakeClient) ContainerDiff(ctx context.Context, containerID string) ([]container.ContainerChangeResponseItem, error) {
+	return c.containerDiffFunc(containerID)
+}
+
+func (c *fakeClient) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	return c.containerListFunc(options)
+}
+
+func (c *fakeClient) ContainerStop(ctx context.Context, containerID string, timeout *time.Duration) error {
+	return c.containerStopFunc(containerID, timeout)
+}
+
+func (c *fakeClient) ContainerExecCreate(ctx context.Context, containerID string, config types.ExecConfig) (types.IDResponse, error) {
+	return c.execCreateFunc(containerID, config)
+}
+
+func (c *fakeClient) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	return c.execAttachFunc(execID, config)
+}
+
+func (c *fakeClient) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	return c.execInspectFunc(execID)
+}
+
+func (c *fakeClient) ContainerStats(ctx context.Context, containerID string, stream bool) (types.ContainerStats, error) {
+	return c.containerStatsFunc(containerID, stream)
+}
+
+func (c *fakeClient) VolumeInspect(ctx context.Context, volumeID string) (types.Volume, error) {
+	return c.volumeInspectFunc(volumeID)
+}
+
+func (c *fakeClient) VolumeCreate(ctx context.Context, options volumetypes.VolumeCreateBody) (types.Volume, error) {
+	return c.volumeCreateFunc(options)
+}
+
+func (c *fakeClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+	return c.imageLoadFunc(input, quiet)
+}
+
+func (c *fakeClient) Info(ctx context.Context) (types.Info, error) {
+	return c.info, c.infoErr
+}
+
+// notFoundError is an error recognized by client.IsErrNotFound
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+func (e notFoundError) NotFound() bool {
+	return true
+}
+
+func newFakeDockerDriver(fc *fakeClient) *DockerDriver {
+	d := &DockerDriver{}
+	d.SetDockerCli(&fakeCli{client: fc})
+	return d
+}
+
+func testOperation() *Operation {
+	return &Operation{
+		Installation: "test",
+		Action:       "install",
+		Image:        "example.com/test:1.2.3",
+		ImageType:    ImageTypeDocker,
+		Environment:  map[string]string{},
+		Files:        map[string]string{},
+		Out:          ioutil.Discard,
+	}
+}
+
+// runConfigs runs op on a driver backed by fc and returns the configuration the container was created with.
+func runConfigs(t *testing.T, d *DockerDriver, fc *fakeClient, op *Operation) (*container.Config, *container.HostConfig) {
+	var (
+		cfg     *container.Config
+		hostCfg *container.HostConfig
+	)
+	create := fc.containerCreateFunc
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		cfg, hostCfg = config, hostConfig
+		return create(config, hostConfig)
+	}
+	if _, err := d.Run(op); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, hostCfg
+}
+
+type tarEntry struct {
+	name    string
+	content string
+	dir     bool
+}
+
+// makeTar builds an in-memory tar archive of the given entries.
+func makeTar(t testing.TB, entries ...tarEntry) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.dir {
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func emptyPull(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("")), nil
+}
+
+func TestDockerDriver_InspectImage(t *testing.T) {
+	is := assert.New(t)
+	pulled := false
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{
+				ID:     "sha256:abc",
+				Config: &container.Config{Labels: map[string]string{"io.cnab.test": "yes"}},
+			}, nil, nil
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulled = true
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	ii, err := d.InspectImage(context.Background(), "example.com/test:1.2.3")
+	is.NoError(err)
+	is.Equal("sha256:abc", ii.ID)
+	is.Equal("yes", ii.Config.Labels["io.cnab.test"])
+	is.False(pulled, "a locally available image should not be pulled")
+}
+
+func TestDockerDriver_InspectImage_PullsMissingImage(t *testing.T) {
+	is := assert.New(t)
+	pulled := false
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			if !pulled {
+				return types.ImageInspect{}, nil, notFoundError("no such image")
+			}
+			return types.ImageInspect{ID: "sha256:abc"}, nil, nil
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulled = true
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	ii, err := d.InspectImage(context.Background(), "example.com/test:1.2.3")
+	is.NoError(err)
+	is.True(pulled)
+	is.Equal("sha256:abc", ii.ID)
+}
+
+func TestDockerDriver_InspectImage_PullError(t *testing.T) {
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return nil, errors.New("registry unavailable")
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.InspectImage(context.Background(), "example.com/test:1.2.3")
+	assert.EqualError(t, err, "registry unavailable")
+}
+
+func TestDockerDriver_SetLogOptions(t *testing.T) {
+	is := assert.New(t)
+	var got *types.ContainerLogsOptions
+	fc := newRunFakeClient()
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		t.Fatal("the container should not be attached to when log options are set")
+		return types.HijackedResponse{}, nil
+	}
+	fc.containerLogsFunc = func(containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+		got = &options
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetLogOptions("100", 10*time.Minute)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.NotNil(got)
+	is.Equal("100", got.Tail)
+	is.Equal("10m0s", got.Since)
+	is.True(got.Follow)
+	is.True(got.ShowStdout)
+	is.True(got.ShowStderr)
+}
+
+func TestDockerDriver_Run_AttachesWithoutLogOptions(t *testing.T) {
+	is := assert.New(t)
+	attached := false
+	fc := newRunFakeClient()
+	attach := fc.containerAttachFunc
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		attached = true
+		is.True(options.Logs)
+		return attach(containerID, options)
+	}
+	fc.containerLogsFunc = func(containerID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+		t.Fatal("logs should be streamed through the attached connection")
+		return nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.True(attached)
+}
+
+func TestDockerDriver_SetHealthcheck(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetHealthcheck([]string{"CMD", "/cnab/app/healthy"}, 5*time.Second, 2*time.Second, 3)
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	is.NotNil(cfg.Healthcheck)
+	is.Equal([]string{"CMD", "/cnab/app/healthy"}, cfg.Healthcheck.Test)
+	is.Equal(5*time.Second, cfg.Healthcheck.Interval)
+	is.Equal(2*time.Second, cfg.Healthcheck.Timeout)
+	is.Equal(3, cfg.Healthcheck.Retries)
+}
+
+func TestDockerDriver_DisableHealthcheck(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.DisableHealthcheck()
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, []string{"NONE"}, cfg.Healthcheck.Test)
+}
+
+func TestDockerDriver_Run_KeepsImageHealthcheckByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Nil(t, cfg.Healthcheck)
+}
+
+func TestDockerDriver_FetchOutputsToDir(t *testing.T) {
+	is := assert.New(t)
+	outputs := makeTar(t,
+		tarEntry{name: "outputs/", dir: true},
+		tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+		tarEntry{name: "outputs/nested/", dir: true},
+		tarEntry{name: "outputs/nested/token", content: "secret"},
+	)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			is.Equal("test-container", containerID)
+			is.Equal("/cnab/app/outputs", srcPath)
+			return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	dir, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.NoError(err)
+	is.Equal([]string{filepath.Join(dir, "kubeconfig"), filepath.Join(dir, "nested", "token")}, written)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "kubeconfig"))
+	is.NoError(err)
+	is.Equal("apiVersion: v1", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dir, "nested", "token"))
+	is.NoError(err)
+	is.Equal("secret", string(content))
+}
+
+func TestDockerDriver_FetchOutputsToDir_NoOutputs(t *testing.T) {
+	is := assert.New(t)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			return nil, types.ContainerPathStat{}, notFoundError("Could not find the file /cnab/app/outputs in container " + containerID)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	dir, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.NoError(err)
+	is.Empty(written)
+}
+
+func TestDockerDriver_FetchOutputsToDir_SingleFile(t *testing.T) {
+	is := assert.New(t)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			return ioutil.NopCloser(makeTar(t, tarEntry{name: "outputs", content: `{"status": "ok"}`})), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	dir, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.NoError(err)
+	is.Equal([]string{filepath.Join(dir, "outputs")}, written)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "outputs"))
+	is.NoError(err)
+	is.Equal(`{"status": "ok"}`, string(content))
+}
+
+func TestDockerDriver_FetchOutputsToDir_PathTraversal(t *testing.T) {
+	is := assert.New(t)
+	outputs := makeTar(t,
+		tarEntry{name: "outputs/", dir: true},
+		tarEntry{name: "outputs/../../evil", content: "gotcha"},
+	)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	parent, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "a", "b")
+	is.NoError(os.MkdirAll(dir, 0755))
+
+	_, err = d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.EqualError(err, "output outputs/../../evil is outside of /cnab/app/outputs")
+	_, err = os.Stat(filepath.Join(parent, "evil"))
+	is.True(os.IsNotExist(err))
+}
+
+func TestDockerDriver_FetchOutputsToDir_KeepsOtherFiles(t *testing.T) {
+	is := assert.New(t)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			outputs := makeTar(t,
+				tarEntry{name: "outputs/", dir: true},
+				tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+			)
+			return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	parent, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "outputs")
+	is.NoError(os.MkdirAll(dir, 0755))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "kubeconfig"), []byte("previous run"), 0644))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "notes"), []byte("kept"), 0644))
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.NoError(err)
+	is.Equal([]string{filepath.Join(dir, "kubeconfig")}, written)
+	content, err := ioutil.ReadFile(filepath.Join(dir, "kubeconfig"))
+	is.NoError(err)
+	is.Equal("apiVersion: v1", string(content))
+	// The directory belongs to the caller, files that are not outputs are left alone.
+	content, err = ioutil.ReadFile(filepath.Join(dir, "notes"))
+	is.NoError(err)
+	is.Equal("kept", string(content))
+
+	entries, err := ioutil.ReadDir(parent)
+	is.NoError(err)
+	is.Len(entries, 1, "temporary directories should be removed")
+}
+
+// readTree returns the content of the files below dir, and the directories as empty strings, by path.
+func readTree(t *testing.T, dir string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			tree[rel+"/"] = ""
+			return nil
+		}
+		content, err := ioutil.ReadFile(path)
+		tree[rel] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestDockerDriver_FetchOutputsToDir_MoveFailureLeavesDestinationUntouched(t *testing.T) {
+	is := assert.New(t)
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			outputs := makeTar(t,
+				tarEntry{name: "outputs/", dir: true},
+				tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+				tarEntry{name: "outputs/nested/", dir: true},
+				tarEntry{name: "outputs/nested/token", content: "secret"},
+			)
+			return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	parent, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "outputs")
+	is.NoError(os.MkdirAll(dir, 0755))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "kubeconfig"), []byte("previous run"), 0644))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "notes"), []byte("kept"), 0644))
+	before := readTree(t, dir)
+
+	// Moving the second output into place fails.
+	defer func(rename func(string, string) error) { renameOutput = rename }(renameOutput)
+	renameOutput = func(oldpath, newpath string) error {
+		if newpath == filepath.Join(dir, "nested", "token") {
+			return errors.New("no space left on device")
+		}
+		return os.Rename(oldpath, newpath)
+	}
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.EqualError(err, "cannot move outputs to "+dir+": no space left on device")
+	is.Nil(written)
+	is.Equal(before, readTree(t, dir))
+	entries, err := ioutil.ReadDir(parent)
+	is.NoError(err)
+	is.Len(entries, 1, "temporary directories should be removed")
+}
+
+func TestDockerDriver_FetchOutputsToDir_FailureLeavesDestinationUntouched(t *testing.T) {
+	is := assert.New(t)
+	outputs := makeTar(t,
+		tarEntry{name: "outputs/", dir: true},
+		tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+		tarEntry{name: "outputs/token", content: strings.Repeat("x", 600)},
+	).Bytes()
+	// The archive is cut in the middle of the content of the last file, which is padded to
+	// 1024 bytes and followed by the 1024 bytes marking the end of the archive.
+	truncated := outputs[:len(outputs)-2048+300]
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			return ioutil.NopCloser(bytes.NewReader(truncated)), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	parent, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(parent)
+	dir := filepath.Join(parent, "outputs")
+	is.NoError(os.MkdirAll(dir, 0755))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "kubeconfig"), []byte("previous run"), 0644))
+
+	written, err := d.FetchOutputsToDir(context.Background(), "test-container", dir)
+	is.Error(err)
+	is.Nil(written)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "kubeconfig"))
+	is.NoError(err)
+	is.Equal("previous run", string(content))
+	entries, err := ioutil.ReadDir(dir)
+	is.NoError(err)
+	is.Len(entries, 1)
+	entries, err = ioutil.ReadDir(parent)
+	is.NoError(err)
+	is.Len(entries, 1, "temporary directories should be removed")
+}
+
+func TestDockerDriver_SetShmSize(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetShmSize(256 * 1024 * 1024)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, int64(256*1024*1024), hostCfg.ShmSize)
+}
+
+func TestDockerDriver_Run_DefaultShmSize(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, int64(0), hostCfg.ShmSize, "the daemon default should be used")
+}
+
+func TestDockerDriver_Run_RemovesContainer(t *testing.T) {
+	is := assert.New(t)
+	var removed string
+	fc := newRunFakeClient()
+	wait := fc.containerWaitFunc
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		is.Equal(container.WaitConditionNotRunning, condition)
+		return wait(containerID, condition)
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		removed = containerID
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.False(hostCfg.AutoRemove)
+	is.Equal("test-container", removed)
+}
+
+func TestDockerDriver_SetCaptureChanges(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerDiffFunc = func(containerID string) ([]container.ContainerChangeResponseItem, error) {
+		is.Equal("test-container", containerID)
+		return []container.ContainerChangeResponseItem{
+			{Kind: 0, Path: "/etc/hosts"},
+			{Kind: 1, Path: "/cnab/app/outputs/kubeconfig"},
+			{Kind: 2, Path: "/tmp/scratch"},
+		}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetCaptureChanges(true)
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal([]FileChange{
+		{Kind: FileChanged, Path: "/etc/hosts"},
+		{Kind: FileAdded, Path: "/cnab/app/outputs/kubeconfig"},
+		{Kind: FileDeleted, Path: "/tmp/scratch"},
+	}, result.Changes)
+}
+
+func TestDockerDriver_Run_DoesNotCaptureChangesByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerDiffFunc = func(containerID string) ([]container.ContainerChangeResponseItem, error) {
+		t.Fatal("changes should not be computed unless requested")
+		return nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Nil(t, result.Changes)
+}
+
+func TestDockerDriver_SetCmd(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetCmd([]string{"--verbose", "deploy"})
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	is.Equal(strslice.StrSlice{"/cnab/app/run"}, cfg.Entrypoint)
+	is.Equal(strslice.StrSlice{"--verbose", "deploy"}, cfg.Cmd)
+}
+
+func TestDockerDriver_Run_NoCmdByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Empty(t, cfg.Cmd)
+}
+
+// copiedFiles runs op on a driver backed by fc and returns the headers of the files copied into the container.
+func copiedFiles(t *testing.T, d *DockerDriver, fc *fakeClient, op *Operation) map[string]*tar.Header {
+	headers := map[string]*tar.Header{}
+	fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+		tr := tar.NewReader(content)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			headers[hdr.Name] = hdr
+		}
+		_, err := io.Copy(ioutil.Discard, content)
+		return err
+	}
+	if _, err := d.Run(op); err != nil {
+		t.Fatal(err)
+	}
+	return headers
+}
+
+func TestDockerDriver_Run_ResolvConf(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config": "config",
+		"/etc/resolv.conf": "nameserver 10.0.0.2\nsearch corp.example.com\noptions ndots:2\n",
+	}
+
+	_, hostCfg := runConfigs(t, d, fc, op)
+	is.Equal([]string{"10.0.0.2"}, hostCfg.DNS)
+	is.Equal([]string{"corp.example.com"}, hostCfg.DNSSearch)
+	is.Equal([]string{"ndots:2"}, hostCfg.DNSOptions)
+
+	headers := copiedFiles(t, d, fc, op)
+	is.Contains(headers, "/cnab/app/config")
+	is.NotContains(headers, "/etc/resolv.conf")
+}
+
+func TestDockerDriver_Run_InvalidResolvConf(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created with an invalid resolv.conf")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Files = map[string]string{"/etc/resolv.conf": "nameserver dns.example.com\n"}
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "invalid /etc/resolv.conf: line 1: nameserver should be followed by an IP address")
+}
+
+func TestDockerDriver_SetFileOwner(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetFileOwner(1000, 2000)
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config":     "config",
+		"/home/user/.kubeconf": "kubeconfig",
+	}
+
+	headers := copiedFiles(t, d, fc, op)
+	is.Len(headers, 2)
+	for name, hdr := range headers {
+		is.Equal(1000, hdr.Uid, name)
+		is.Equal(2000, hdr.Gid, name)
+	}
+}
+
+func TestDockerDriver_Run_FilesOwnedByRootByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Files = map[string]string{"/cnab/app/config": "config"}
+
+	hdr := copiedFiles(t, d, fc, op)["/cnab/app/config"]
+	assert.Equal(t, 0, hdr.Uid)
+	assert.Equal(t, 0, hdr.Gid)
+}
+
+func TestDockerDriver_SetTarModTime(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	modTime := time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)
+	d.SetTarModTime(modTime)
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config":     "config",
+		"/home/user/.kubeconf": "kubeconfig",
+	}
+
+	headers := copiedFiles(t, d, fc, op)
+	is.Len(headers, 2)
+	for name, hdr := range headers {
+		is.True(modTime.Equal(hdr.ModTime), name)
+	}
+}
+
+func TestGenerateTar_Reproducible(t *testing.T) {
+	is := assert.New(t)
+	files := map[string]string{}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("/cnab/app/file-%d", i)] = fmt.Sprintf("content %d", i)
+	}
+	opts := tarOptions{modTime: defaultTarModTime}
+	generate := func() []byte {
+		r, err := generateTar(files, opts)
+		is.NoError(err)
+		data, err := ioutil.ReadAll(r)
+		is.NoError(err)
+		return data
+	}
+
+	is.Equal(generate(), generate())
+}
+
+func TestDockerDriver_Run_TarModTimeIsEpochByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Files = map[string]string{"/cnab/app/config": "config"}
+
+	hdr := copiedFiles(t, d, fc, op)["/cnab/app/config"]
+	assert.Equal(t, int64(0), hdr.ModTime.Unix())
+}
+
+func TestDockerDriver_Run_RetriesTransientStartErrors(t *testing.T) {
+	is := assert.New(t)
+	starts := 0
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		starts++
+		if starts == 1 {
+			return errors.New("Error response from daemon: device or resource busy")
+		}
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetStartRetry(3, time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(2, starts)
+}
+
+func TestDockerDriver_Run_StartRetryExhausted(t *testing.T) {
+	is := assert.New(t)
+	starts := 0
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		starts++
+		return errors.New("Error response from daemon: device or resource busy")
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetStartRetry(3, time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.EqualError(err, "cannot start container: Error response from daemon: device or resource busy")
+	is.Equal(3, starts)
+}
+
+func TestDockerDriver_Run_DoesNotRetryPermanentStartErrors(t *testing.T) {
+	is := assert.New(t)
+	starts := 0
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		starts++
+		return notFoundError("Error: No such container: test-container")
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetStartRetry(3, time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.Error(err)
+	is.Equal(1, starts)
+}
+
+func TestDockerDriver_Run_DoesNotRetryCreateOnConnectionFailure(t *testing.T) {
+	is := assert.New(t)
+	creates := 0
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		creates++
+		return container.ContainerCreateCreatedBody{}, client.ErrorConnectionFailed("unix:///var/run/docker.sock")
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetStartRetry(3, time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.Error(err)
+	is.Equal(1, creates, "the daemon may have created the container before the connection failed")
+}
+
+func TestRetryPolicy_StopsWaitingWhenContextIsDone(t *testing.T) {
+	is := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	p := retryPolicy{attempts: 3, backoff: time.Hour}
+
+	start := time.Now()
+	err := p.do(ctx, func() error {
+		attempts++
+		cancel()
+		return errors.New("Error response from daemon: device or resource busy")
+	}, isTransientDaemonError)
+	is.Equal(context.Canceled, err)
+	is.Equal(1, attempts)
+	is.True(time.Since(start) < time.Minute)
+}
+
+func TestDockerDriver_SetPrivileged(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetPrivileged(true)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.True(t, hostCfg.Privileged)
+}
+
+func TestDockerDriver_Run_NotPrivilegedByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.False(t, hostCfg.Privileged)
+}
+
+func TestDockerDriver_SetInit(t *testing.T) {
+	for _, init := range []bool{true, false} {
+		fc := newRunFakeClient()
+		d := newFakeDockerDriver(fc)
+		d.SetInit(init)
+
+		_, hostCfg := runConfigs(t, d, fc, testOperation())
+		if assert.NotNil(t, hostCfg.Init) {
+			assert.Equal(t, init, *hostCfg.Init)
+		}
+	}
+}
+
+func TestDockerDriver_Run_InitUnsetByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Nil(t, hostCfg.Init)
+}
+
+func TestDockerDriver_SetTraceEnv(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetTraceEnv(map[string]string{
+		"BUILD_ID":     "42",
+		"GIT_COMMIT":   "abc123",
+		"PIPELINE_URL": "https://ci.example.com/42",
+	})
+	op := testOperation()
+	op.Environment = map[string]string{
+		"GIT_COMMIT":  "def456",
+		"CNAB_ACTION": "install",
+	}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	is.ElementsMatch([]string{
+		"BUILD_ID=42",
+		"PIPELINE_URL=https://ci.example.com/42",
+		"GIT_COMMIT=def456",
+		"CNAB_ACTION=install",
+	}, cfg.Env)
+}
+
+func TestDockerDriver_Run_SortedEnv(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetTraceEnv(map[string]string{"BUILD_ID": "42"})
+	op := testOperation()
+	op.Environment = map[string]string{
+		"CNAB_P_REPLICAS":        "3",
+		"CNAB_ACTION":            "install",
+		"CNAB_INSTALLATION_NAME": "test",
+		"A":                      "1",
+		"A0":                     "2",
+		"ZONE":                   "eu",
+	}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.Equal(t, []string{
+		"A=1",
+		"A0=2",
+		"BUILD_ID=42",
+		"CNAB_ACTION=install",
+		"CNAB_INSTALLATION_NAME=test",
+		"CNAB_P_REPLICAS=3",
+		"ZONE=eu",
+	}, cfg.Env)
+}
+
+type spanKey struct{}
+
+// injectTestSpan injects the span carried by the context, if any, as a trace context.
+func injectTestSpan(ctx context.Context, headers map[string]string) {
+	if span, ok := ctx.Value(spanKey{}).(string); ok {
+		headers["traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span + "-01"
+		headers["tracestate"] = "vendor=value"
+	}
+}
+
+func TestDockerDriver_SetTraceContextInjector(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetTraceContextInjector(injectTestSpan)
+	op := testOperation()
+	op.Context = context.WithValue(context.Background(), spanKey{}, "00f067aa0ba902b7")
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.ElementsMatch(t, []string{
+		"TRACEPARENT=00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"TRACESTATE=vendor=value",
+	}, cfg.Env)
+}
+
+func TestDockerDriver_SetTraceContextInjector_NoTrace(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetTraceContextInjector(injectTestSpan)
+	op := testOperation()
+	op.Context = context.Background()
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.Empty(t, cfg.Env)
+}
+
+func TestDockerDriver_SetPidMode(t *testing.T) {
+	for _, mode := range []string{"host", "container:monitored"} {
+		fc := newRunFakeClient()
+		d := newFakeDockerDriver(fc)
+		assert.NoError(t, d.SetPidMode(mode))
+
+		_, hostCfg := runConfigs(t, d, fc, testOperation())
+		assert.Equal(t, container.PidMode(mode), hostCfg.PidMode)
+	}
+}
+
+func TestDockerDriver_SetPidMode_Invalid(t *testing.T) {
+	d := &DockerDriver{}
+	for _, mode := range []string{"private", "container:", "container"} {
+		assert.EqualError(t, d.SetPidMode(mode), fmt.Sprintf("invalid PID mode %q", mode))
+	}
+}
+
+func TestDockerDriver_Run_LabelsContainer(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, "docker", cfg.Labels[DriverLabel])
+}
+
+func TestDockerDriver_PruneContainers(t *testing.T) {
+	is := assert.New(t)
+	now := time.Now()
+	var removed []string
+	fc := &fakeClient{
+		containerListFunc: func(options types.ContainerListOptions) ([]types.Container, error) {
+			is.True(options.All)
+			is.Equal([]string{DriverLabel}, options.Filters.Get("label"))
+			return []types.Container{
+				{ID: "stale", State: "exited", Created: now.Add(-2 * time.Hour).Unix()},
+				{ID: "stale-created", State: "created", Created: now.Add(-3 * time.Hour).Unix()},
+				{ID: "running", State: "running", Created: now.Add(-2 * time.Hour).Unix()},
+				{ID: "recent", State: "exited", Created: now.Add(-time.Minute).Unix()},
+			}, nil
+		},
+		containerRemoveFunc: func(containerID string, options types.ContainerRemoveOptions) error {
+			removed = append(removed, containerID)
+			return nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	ids, err := d.PruneContainers(context.Background(), time.Hour)
+	is.NoError(err)
+	is.Equal([]string{"stale", "stale-created"}, ids)
+	is.Equal(ids, removed)
+}
+
+func TestDockerDriver_PruneContainers_RemoveError(t *testing.T) {
+	is := assert.New(t)
+	old := time.Now().Add(-2 * time.Hour).Unix()
+	fc := &fakeClient{
+		containerListFunc: func(options types.ContainerListOptions) ([]types.Container, error) {
+			return []types.Container{
+				{ID: "first", State: "exited", Created: old},
+				{ID: "second", State: "exited", Created: old},
+			}, nil
+		},
+		containerRemoveFunc: func(containerID string, options types.ContainerRemoveOptions) error {
+			if containerID == "second" {
+				return errors.New("removal of container second is already in progress")
+			}
+			return nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	ids, err := d.PruneContainers(context.Background(), time.Hour)
+	is.EqualError(err, "cannot remove container second: removal of container second is already in progress")
+	is.Equal([]string{"first"}, ids)
+}
+
+func TestDockerDriver_Run_NoFiles(t *testing.T) {
+	for _, files := range []map[string]string{nil, {}} {
+		fc := newRunFakeClient()
+		fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+			t.Fatal("nothing should be copied into the container when the operation has no files")
+			return nil
+		}
+		started := false
+		fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+			started = true
+			return nil
+		}
+		d := newFakeDockerDriver(fc)
+		op := testOperation()
+		op.Files = files
+
+		result, err := d.Run(op)
+		assert.NoError(t, err)
+		assert.True(t, started)
+		assert.Equal(t, 0, result.ExitCode)
+	}
+}
+
+func TestDockerDriver_SetTarDumpPath(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "tardump")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	dumpPath := filepath.Join(dir, "files.tar")
+
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetTarDumpPath(dumpPath)
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config":     "config",
+		"/home/user/.kubeconf": "kubeconfig",
+	}
+	copied := copiedFiles(t, d, fc, op)
+	is.Len(copied, 2)
+
+	f, err := os.Open(dumpPath)
+	is.NoError(err)
+	defer f.Close()
+	dumped := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		is.NoError(err)
+		content, err := ioutil.ReadAll(tr)
+		is.NoError(err)
+		dumped[hdr.Name] = string(content)
+	}
+	is.Equal(op.Files, dumped)
+}
+
+func TestDockerDriver_SetCgroupParent(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetCgroupParent("/tenants/acme")
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, "/tenants/acme", hostCfg.CgroupParent)
+}
+
+func TestDockerDriver_Run_FetchesOutputs(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		is.Equal("/cnab/app/outputs", srcPath)
+		outputs := makeTar(t,
+			tarEntry{name: "outputs", dir: true},
+			tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+			tarEntry{name: "outputs/nested", dir: true},
+			tarEntry{name: "outputs/nested/token", content: "secret"},
+		)
+		return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(map[string]string{
+		"/cnab/app/outputs/kubeconfig":   "apiVersion: v1",
+		"/cnab/app/outputs/nested/token": "secret",
+	}, result.Outputs)
+}
+
+func TestDockerDriver_Run_FetchOutputsRetriesTransientErrors(t *testing.T) {
+	is := assert.New(t)
+	defer func(p retryPolicy) { fetchOutputsRetry = p }(fetchOutputsRetry)
+	fetchOutputsRetry = retryPolicy{attempts: 3, backoff: time.Millisecond}
+
+	calls := 0
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		calls++
+		if calls == 1 {
+			return nil, types.ContainerPathStat{}, errors.New("device or resource busy")
+		}
+		outputs := makeTar(t,
+			tarEntry{name: "outputs", dir: true},
+			tarEntry{name: "outputs/report", content: "healthy"},
+		)
+		return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(2, calls)
+	is.Equal(map[string]string{"/cnab/app/outputs/report": "healthy"}, result.Outputs)
+}
+
+func TestDockerDriver_Run_FetchOutputsDoesNotRetryMissingDirectory(t *testing.T) {
+	is := assert.New(t)
+	calls := 0
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		calls++
+		return nil, types.ContainerPathStat{}, notFoundError("Could not find the file /cnab/app/outputs in container " + containerID)
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(1, calls)
+	is.Nil(result.Outputs)
+}
+
+func TestDockerDriver_Run_OutputsAction(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		outputs := makeTar(t,
+			tarEntry{name: "outputs", dir: true},
+			tarEntry{name: "outputs/report", content: "healthy"},
+		)
+		return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	for _, action := range []string{"install", "status"} {
+		op := testOperation()
+		op.Action = action
+		result, err := d.Run(op)
+		is.NoError(err)
+		is.Equal(map[string]string{"/cnab/app/outputs/report": "healthy"}, result.Outputs)
+		is.Equal(action, result.Action)
+	}
+}
+
+func TestDockerDriver_Run_FetchesSingleFileOutputs(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		outputs := makeTar(t, tarEntry{name: "outputs", content: `{"status": "ok"}`})
+		return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(map[string]string{"/cnab/app/outputs": `{"status": "ok"}`}, result.Outputs)
+}
+
+func TestDockerDriver_Run_NoOutputs(t *testing.T) {
+	d := newFakeDockerDriver(newRunFakeClient())
+
+	result, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Nil(t, result.Outputs)
+}
+
+func TestDockerDriver_ClientOptions(t *testing.T) {
+	is := assert.New(t)
+	d := &DockerDriver{}
+	opts := d.clientOptions()
+	is.Empty(opts.Common.Hosts)
+	is.Empty(opts.Common.Context)
+
+	d.SetDockerHost("tcp://docker.example.com:2376")
+	d.SetDockerContext("remote")
+	opts = d.clientOptions()
+	is.Equal([]string{"tcp://docker.example.com:2376"}, opts.Common.Hosts)
+	is.Equal("remote", opts.Common.Context)
+}
+
+func TestDockerDriver_SetMemorySwap(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetMemory(512 * 1024 * 1024)
+	d.SetMemorySwap(1024 * 1024 * 1024)
+	d.SetMemorySwappiness(10)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.Equal(int64(512*1024*1024), hostCfg.Resources.Memory)
+	is.Equal(int64(1024*1024*1024), hostCfg.Resources.MemorySwap)
+	is.Equal(int64(10), *hostCfg.Resources.MemorySwappiness)
+}
+
+func TestDockerDriver_SetMemorySwap_LowerThanMemory(t *testing.T) {
+	d := newFakeDockerDriver(newRunFakeClient())
+	d.SetMemory(1024)
+	d.SetMemorySwap(512)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "memory swap limit 512 should be greater than or equal to the memory limit 1024")
+
+	d.SetMemorySwap(-1)
+	_, err = d.Run(testOperation())
+	assert.NoError(t, err)
+}
+
+func TestDockerDriver_AddVolume(t *testing.T) {
+	is := assert.New(t)
+	var created []string
+	fc := newRunFakeClient()
+	fc.volumeInspectFunc = func(volumeID string) (types.Volume, error) {
+		if volumeID == "existing" {
+			return types.Volume{Name: volumeID}, nil
+		}
+		return types.Volume{}, notFoundError("get " + volumeID + ": no such volume")
+	}
+	fc.volumeCreateFunc = func(options volumetypes.VolumeCreateBody) (types.Volume, error) {
+		created = append(created, options.Name)
+		return types.Volume{Name: options.Name}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.AddVolume("existing", "/cnab/app/cache", true)
+	d.AddVolume("state", "/cnab/app/state", false)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.Equal([]mount.Mount{
+		{Type: mount.TypeVolume, Source: "existing", Target: "/cnab/app/cache", ReadOnly: true},
+		{Type: mount.TypeVolume, Source: "state", Target: "/cnab/app/state"},
+	}, hostCfg.Mounts)
+	is.Equal([]string{"state"}, created)
+}
+
+func TestDockerDriver_AddVolume_InspectError(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.volumeInspectFunc = func(volumeID string) (types.Volume, error) {
+		return types.Volume{}, errors.New("permission denied")
+	}
+	d := newFakeDockerDriver(fc)
+	d.AddVolume("state", "/cnab/app/state", false)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "cannot inspect volume state: permission denied")
+}
+
+func TestDockerDriver_AddBindMount(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	is.NoError(d.AddBindMount("/var/lib/kubelet/pods", "/pods", false, "rshared"))
+	is.NoError(d.AddBindMount("/etc/ssl/certs", "/etc/ssl/certs", true, ""))
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.Equal([]mount.Mount{
+		{
+			Type:        mount.TypeBind,
+			Source:      "/var/lib/kubelet/pods",
+			Target:      "/pods",
+			BindOptions: &mount.BindOptions{Propagation: mount.PropagationRShared},
+		},
+		{Type: mount.TypeBind, Source: "/etc/ssl/certs", Target: "/etc/ssl/certs", ReadOnly: true},
+	}, hostCfg.Mounts)
+}
+
+func TestDockerDriver_AddBindMount_InvalidPropagation(t *testing.T) {
+	d := &DockerDriver{}
+	assert.EqualError(t, d.AddBindMount("/mnt", "/mnt", false, "recursive"), `invalid mount propagation "recursive"`)
+	assert.Empty(t, d.mounts)
+}
+
+// delayedReader reads from r once delay has elapsed.
+type delayedReader struct {
+	r     io.Reader
+	delay time.Duration
+}
+
+func (r *delayedReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	r.delay = 0
+	return r.r.Read(p)
+}
+
+func TestDockerDriver_Run_DrainsOutput(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		first, last := &bytes.Buffer{}, &bytes.Buffer{}
+		fmt.Fprint(stdcopy.NewStdWriter(first, stdcopy.Stdout), "starting\n")
+		fmt.Fprint(stdcopy.NewStdWriter(last, stdcopy.Stdout), "done\n")
+		// The container exits right away, while its last line is still on its way.
+		content := io.MultiReader(first, &delayedReader{r: last, delay: 100 * time.Millisecond})
+		conn, _ := net.Pipe()
+		return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(content)}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.ContainerOut = out
+
+	_, err := d.Run(op)
+	is.NoError(err)
+	is.Equal("starting\ndone\n", out.String())
+}
+
+func TestDockerDriver_SetOutputDrainGrace(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		// The stream never ends, as if it was still open after the container exited.
+		conn, _ := net.Pipe()
+		return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(conn)}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetOutputDrainGrace(10 * time.Millisecond)
+
+	start := time.Now()
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.True(time.Since(start) < defaultOutputDrainGrace, "the run should not wait past the grace")
+}
+
+// drainSignal closes drained when the attached stream has been fully read, then ends the stream.
+type drainSignal struct {
+	drained chan struct{}
+	once    sync.Once
+}
+
+func (s *drainSignal) Read(p []byte) (int, error) {
+	s.once.Do(func() { close(s.drained) })
+	return 0, io.EOF
+}
+
+// logFileFakeClient returns a fakeClient whose container writes to its output and error streams,
+// and only exits once they were read.
+func logFileFakeClient() *fakeClient {
+	drained := make(chan struct{})
+	fc := newRunFakeClient()
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		content := &bytes.Buffer{}
+		fmt.Fprint(stdcopy.NewStdWriter(content, stdcopy.Stdout), "installing\n")
+		fmt.Fprint(stdcopy.NewStdWriter(content, stdcopy.Stderr), "warning: deprecated\n")
+		conn, _ := net.Pipe()
+		signal := &drainSignal{drained: drained}
+		return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(io.MultiReader(content, signal))}, nil
+	}
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		statusc := make(chan container.ContainerWaitOKBody, 1)
+		go func() {
+			<-drained
+			statusc <- container.ContainerWaitOKBody{StatusCode: 0}
+		}()
+		return statusc, make(chan error)
+	}
+	return fc
+}
+
+func TestDockerDriver_SetLogFile(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "logs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.log")
+
+	d := newFakeDockerDriver(logFileFakeClient())
+	d.SetLogFile(path)
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.ContainerOut, op.ContainerErr = out, out
+
+	_, err = d.Run(op)
+	is.NoError(err)
+	content, err := ioutil.ReadFile(path)
+	is.NoError(err)
+	is.Equal("installing\nwarning: deprecated\n", string(content))
+	is.Equal("installing\nwarning: deprecated\n", out.String(), "the output should still be streamed")
+
+	_, err = newFakeDockerDriver(logFileFakeClient()).Run(op)
+	is.NoError(err, "the log file is only used when set")
+	d = newFakeDockerDriver(logFileFakeClient())
+	d.SetLogFile(path)
+	_, err = d.Run(op)
+	is.EqualError(err, fmt.Sprintf("log file %s already exists", path))
+}
+
+func TestDockerDriver_SetRotateLogFile(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "logs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run.log")
+	is.NoError(ioutil.WriteFile(path, []byte("previous run\n"), 0644))
+	modTime := time.Date(2019, time.January, 2, 15, 4, 5, 0, time.UTC)
+	is.NoError(os.Chtimes(path, modTime, modTime))
+
+	d := newFakeDockerDriver(logFileFakeClient())
+	d.SetLogFile(path)
+	d.SetRotateLogFile(true)
+	op := testOperation()
+	op.ContainerOut, op.ContainerErr = ioutil.Discard, ioutil.Discard
+
+	_, err = d.Run(op)
+	is.NoError(err)
+	content, err := ioutil.ReadFile(path)
+	is.NoError(err)
+	is.Equal("installing\nwarning: deprecated\n", string(content))
+	content, err = ioutil.ReadFile(path + ".20190102T150405Z")
+	is.NoError(err)
+	is.Equal("previous run\n", string(content))
+}
+
+func TestDockerDriver_Run_OperationWriters(t *testing.T) {
+	is := assert.New(t)
+	var (
+		mu      sync.Mutex
+		drained = map[string]chan struct{}{}
+	)
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		// The container is named after the operation, so that each one produces distinct output.
+		id := strings.TrimPrefix(config.Env[0], "NAME=")
+		mu.Lock()
+		drained[id] = make(chan struct{})
+		mu.Unlock()
+		return container.ContainerCreateCreatedBody{ID: id}, nil
+	}
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		content := &bytes.Buffer{}
+		fmt.Fprintf(stdcopy.NewStdWriter(content, stdcopy.Stdout), "output of %s\n", containerID)
+		fmt.Fprintf(stdcopy.NewStdWriter(content, stdcopy.Stderr), "error of %s\n", containerID)
+		mu.Lock()
+		signal := &drainSignal{drained: drained[containerID]}
+		mu.Unlock()
+		conn, _ := net.Pipe()
+		return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(io.MultiReader(content, signal))}, nil
+	}
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		mu.Lock()
+		done := drained[containerID]
+		mu.Unlock()
+		statusc := make(chan container.ContainerWaitOKBody, 1)
+		go func() {
+			<-done
+			statusc <- container.ContainerWaitOKBody{StatusCode: 0}
+		}()
+		return statusc, make(chan error)
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetContainerOut(ioutil.Discard)
+	d.SetContainerErr(ioutil.Discard)
+
+	names := []string{"first", "second"}
+	stdout := map[string]*bytes.Buffer{}
+	stderr := map[string]*bytes.Buffer{}
+	var wg sync.WaitGroup
+	for _, name := range names {
+		op := testOperation()
+		op.Environment = map[string]string{"NAME": name}
+		stdout[name], stderr[name] = &bytes.Buffer{}, &bytes.Buffer{}
+		op.ContainerOut, op.ContainerErr = stdout[name], stderr[name]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.Run(op)
+			is.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		is.Equal("output of "+name+"\n", stdout[name].String())
+		is.Equal("error of "+name+"\n", stderr[name].String())
+	}
+}
+
+func TestDockerDriver_SetEnvAllowlist(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetEnvAllowlist([]string{"CNAB_ACTION", "CNAB_P_REPLICAS"})
+	op := testOperation()
+	op.Environment = map[string]string{
+		"CNAB_ACTION":     "install",
+		"CNAB_P_REPLICAS": "3",
+		"AWS_SECRET_KEY":  "secret",
+	}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.ElementsMatch(t, []string{"CNAB_ACTION=install", "CNAB_P_REPLICAS=3"}, cfg.Env)
+}
+
+func TestDockerDriver_SetRejectDisallowedEnv(t *testing.T) {
+	is := assert.New(t)
+	d := newFakeDockerDriver(newRunFakeClient())
+	d.SetEnvAllowlist([]string{"CNAB_ACTION"})
+	d.SetRejectDisallowedEnv(true)
+	op := testOperation()
+	op.Environment = map[string]string{
+		"CNAB_ACTION":    "install",
+		"AWS_SECRET_KEY": "secret",
+		"AWS_ACCESS_KEY": "key",
+	}
+
+	_, err := d.Run(op)
+	is.EqualError(err, "environment variables not allowed: AWS_ACCESS_KEY, AWS_SECRET_KEY")
+
+	op.Environment = map[string]string{"CNAB_ACTION": "install"}
+	_, err = d.Run(op)
+	is.NoError(err)
+}
+
+func TestDockerDriver_Run_ArchitectureMismatch(t *testing.T) {
+	is := assert.New(t)
+	started := false
+	fc := newRunFakeClient()
+	fc.info = types.Info{Architecture: "x86_64"}
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{ID: "sha256:abc", Architecture: "arm64"}, nil, nil
+	}
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		started = true
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	is.EqualError(err, "image example.com/test:1.2.3 is built for the arm64 architecture and cannot run on amd64")
+	is.False(started)
+
+	d.SetArchitecture("arm64")
+	_, err = d.Run(testOperation())
+	is.NoError(err)
+	is.True(started)
+}
+
+func TestDockerDriver_Run_ArchitectureMatch(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.info = types.Info{Architecture: "aarch64"}
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{ID: "sha256:abc", Architecture: "arm64"}, nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	assert.NoError(t, err)
+}
+
+func TestDockerDriver_Run_UnknownHostArchitecture(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.infoErr = errors.New("info is not available")
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{ID: "sha256:abc", Architecture: "arm64"}, nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	assert.NoError(t, err)
+}
+
+func TestDockerDriver_Run_InspectsImageOnce(t *testing.T) {
+	is := assert.New(t)
+	inspected := 0
+	fc := newRunFakeClient()
+	fc.info = types.Info{Architecture: "x86_64"}
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		inspected++
+		return types.ImageInspect{
+			ID:           "sha256:abc",
+			Architecture: "amd64",
+			RepoDigests:  []string{"example.com/test@" + testDigest},
+		}, nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRunManifest(true)
+	op := testOperation()
+	op.Image = "example.com/test@" + testDigest
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.Equal(1, inspected)
+	is.Equal("sha256:abc", result.RunManifest.ImageID)
+}
+
+func TestDockerDriver_SetRunTimeout(t *testing.T) {
+	is := assert.New(t)
+	var stopped []string
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		// The container never exits.
+		return make(chan container.ContainerWaitOKBody), make(chan error)
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		stopped = append(stopped, containerID)
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRunTimeout(10 * time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.EqualError(err, "container did not exit within 10ms")
+	is.Equal([]string{"test-container"}, stopped)
+}
+
+func TestDockerDriver_Run_ContextCanceled(t *testing.T) {
+	is := assert.New(t)
+	var stopped []string
+	ctx, cancel := context.WithCancel(context.Background())
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		cancel()
+		return nil
+	}
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		// The container never exits.
+		return make(chan container.ContainerWaitOKBody), make(chan error)
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		stopped = append(stopped, containerID)
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Context = ctx
+
+	_, err := d.Run(op)
+	is.EqualError(err, "operation canceled: context canceled")
+	is.Equal([]string{"test-container"}, stopped)
+}
+
+func TestDockerDriver_SetRunTimeout_StopError(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		return make(chan container.ContainerWaitOKBody), make(chan error)
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		return errors.New("cannot kill container: permission denied")
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRunTimeout(10 * time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "container did not exit within 10ms and could not be stopped: cannot kill container: permission denied")
+}
+
+func TestDockerDriver_SetAllowOverwriteDirWithFile(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		var copyOptions types.CopyToContainerOptions
+		fc := newRunFakeClient()
+		fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+			copyOptions = options
+			_, err := io.Copy(ioutil.Discard, content)
+			return err
+		}
+		d := newFakeDockerDriver(fc)
+		d.SetAllowOverwriteDirWithFile(allow)
+
+		_, err := d.Run(testOperation())
+		assert.NoError(t, err)
+		assert.Equal(t, allow, copyOptions.AllowOverwriteDirWithFile)
+	}
+}
+
+type fakeMetrics struct {
+	totals    []string
+	durations []string
+}
+
+func (m *fakeMetrics) IncRunTotal(action, status string) {
+	m.totals = append(m.totals, action+" "+status)
+}
+
+func (m *fakeMetrics) ObserveRunDuration(action string, duration time.Duration) {
+	if duration > 0 {
+		m.durations = append(m.durations, action)
+	}
+}
+
+func TestDockerDriver_SetMetrics(t *testing.T) {
+	is := assert.New(t)
+	metrics := &fakeMetrics{}
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetMetrics(metrics)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		return notFoundError("No such container: " + containerID)
+	}
+	op := testOperation()
+	op.Action = "upgrade"
+	_, err = d.Run(op)
+	is.Error(err)
+
+	is.Equal([]string{"install success", "upgrade failure"}, metrics.totals)
+	is.Equal([]string{"install", "upgrade"}, metrics.durations)
+}
+
+func TestDockerDriver_Pull(t *testing.T) {
+	is := assert.New(t)
+	var pulled []string
+	local := map[string]bool{"example.com/cached:1.0.0": true}
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			if !local[image] {
+				return types.ImageInspect{}, nil, notFoundError("no such image")
+			}
+			return types.ImageInspect{ID: "sha256:abc"}, nil, nil
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			pulled = append(pulled, ref)
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	is.NoError(d.Pull(context.Background(), "example.com/cached:1.0.0"))
+	is.NoError(d.Pull(context.Background(), "example.com/test:1.2.3"))
+	is.Equal([]string{"example.com/test:1.2.3"}, pulled)
+
+	d.SetConfig(map[string]string{"PULL_ALWAYS": "1"})
+	is.NoError(d.Pull(context.Background(), "example.com/cached:1.0.0"))
+	is.Equal([]string{"example.com/test:1.2.3", "example.com/cached:1.0.0"}, pulled)
+}
+
+func TestDockerDriver_Pull_Error(t *testing.T) {
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			return nil, errors.New("unauthorized: authentication required")
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	err := d.Pull(context.Background(), "example.com/test:1.2.3")
+	assert.EqualError(t, err, "cannot pull image example.com/test:1.2.3: unauthorized: authentication required")
+}
+
+func TestDockerDriver_SetDockerConfigJSON(t *testing.T) {
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "pull-secret")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".dockerconfigjson")
+	auth := func(user, password string) string {
+		return base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+	}
+	secret := fmt.Sprintf(`{"auths": {
+		"https://index.docker.io/v1/": {"auth": %q},
+		"registry.example.com": {"auth": %q},
+		"https://mirror.example.com:5000/v2/": {"auth": %q}
+	}}`, auth("hub", "hub-password"), auth("registry", "registry-password"), auth("mirror", "mirror-password"))
+	is.NoError(ioutil.WriteFile(path, []byte(secret), 0600))
+
+	var pulled types.AuthConfig
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			decoded, err := base64.URLEncoding.DecodeString(options.RegistryAuth)
+			is.NoError(err)
+			pulled = types.AuthConfig{}
+			is.NoError(json.Unmarshal(decoded, &pulled))
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetDockerConfigJSON(path)
+
+	for _, tc := range []struct{ image, user, password string }{
+		{image: "registry.example.com/app:1.0.0", user: "registry", password: "registry-password"},
+		{image: "mirror.example.com:5000/app:1.0.0", user: "mirror", password: "mirror-password"},
+		{image: "cnab/helloworld:0.1.0", user: "hub", password: "hub-password"},
+		{image: "unknown.example.com/app:1.0.0"},
+	} {
+		is.NoError(d.Pull(context.Background(), tc.image))
+		is.Equal(tc.user, pulled.Username, tc.image)
+		is.Equal(tc.password, pulled.Password, tc.image)
+	}
+
+	d.SetDockerConfigJSON(filepath.Join(dir, "missing"))
+	err = d.Pull(context.Background(), "registry.example.com/app:1.0.0")
+	is.Error(err)
+	is.Contains(err.Error(), "cannot read docker config")
+}
+
+func TestDockerDriver_PullBundleImages(t *testing.T) {
+	is := assert.New(t)
+	refs := []string{"example.com/invocation:1.0.0", "example.com/web:1.0.0", "example.com/db:1.0.0", "example.com/private:1.0.0"}
+	var (
+		mu       sync.Mutex
+		inFlight int
+		started  = make(chan struct{})
+	)
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			// Every pull waits for all of them to be in flight, which only happens when they run concurrently.
+			mu.Lock()
+			inFlight++
+			if inFlight == len(refs) {
+				close(started)
+			}
+			mu.Unlock()
+			select {
+			case <-started:
+			case <-time.After(5 * time.Second):
+				return nil, errors.New("pulls are not concurrent")
+			}
+			if strings.Contains(ref, "private") || strings.Contains(ref, "db") {
+				return nil, errors.New("unauthorized: authentication required")
+			}
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetMaxConcurrentPulls(len(refs))
+
+	err := d.PullBundleImages(context.Background(), refs)
+	var pullErr *PullError
+	if !errors.As(err, &pullErr) {
+		t.Fatalf("expected a *PullError, got %v", err)
+	}
+	is.Len(pullErr.Errors, 2)
+	is.EqualError(err, "cannot pull bundle images: "+
+		"cannot pull image example.com/db:1.0.0: unauthorized: authentication required; "+
+		"cannot pull image example.com/private:1.0.0: unauthorized: authentication required")
+}
+
+func TestDockerDriver_SetMaxConcurrentPulls(t *testing.T) {
+	is := assert.New(t)
+	var (
+		mu          sync.Mutex
+		inFlight    int
+		maxInFlight int
+	)
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			mu.Lock()
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetMaxConcurrentPulls(2)
+
+	var refs []string
+	for i := 0; i < 8; i++ {
+		refs = append(refs, fmt.Sprintf("example.com/image-%d:1.0.0", i))
+	}
+	is.NoError(d.PullBundleImages(context.Background(), refs))
+	is.Equal(2, maxInFlight)
+}
+
+func TestDockerDriver_PullBundleImages_Cancelled(t *testing.T) {
+	is := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		mu     sync.Mutex
+		pulled []string
+	)
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			pulled = append(pulled, ref)
+			cancel()
+			return nil, context.Canceled
+		},
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetMaxConcurrentPulls(1)
+
+	err := d.PullBundleImages(ctx, []string{"example.com/web:1.0.0", "example.com/db:1.0.0", "example.com/cache:1.0.0"})
+	is.Equal(context.Canceled, err)
+	is.Equal([]string{"example.com/web:1.0.0"}, pulled)
+}
+
+func TestDockerDriver_PullBundleImages_Cached(t *testing.T) {
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{ID: "sha256:abc"}, nil, nil
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			// Pulls run in their own goroutines, where the test cannot be stopped.
+			t.Errorf("image %s is available locally and should not be pulled", ref)
+			return emptyPull(ref, options)
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	assert.NoError(t, d.PullBundleImages(context.Background(), []string{"example.com/web:1.0.0", "example.com/db:1.0.0"}))
+}
+
+func TestDockerDriver_PullBundleImages_Output(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		started int
+		both    = make(chan struct{})
+	)
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			name := strings.TrimSuffix(strings.TrimPrefix(ref, "example.com/"), ":1.0.0")
+			r, w := io.Pipe()
+			go func() {
+				defer w.Close()
+				fmt.Fprintf(w, `{"status":"Pulling %s"}`+"\n", name)
+				// The second line of each pull is only written once both pulls wrote their first one.
+				mu.Lock()
+				started++
+				if started == 2 {
+					close(both)
+				}
+				mu.Unlock()
+				<-both
+				fmt.Fprintf(w, `{"status":"Pulled %s"}`+"\n", name)
+			}()
+			return r, nil
+		},
+	}
+	out := &bytes.Buffer{}
+	d := &DockerDriver{}
+	d.SetDockerCli(&fakeCli{client: fc, out: out})
+
+	assert.NoError(t, d.PullBundleImages(context.Background(), []string{"example.com/web:1.0.0", "example.com/db:1.0.0"}))
+	assert.Contains(t, []string{
+		"Pulling web\nPulled web\nPulling db\nPulled db\n",
+		"Pulling db\nPulled db\nPulling web\nPulled web\n",
+	}, out.String())
+}
+
+func TestDockerDriver_PullBundleImages_ResolvesAndLoadsLocalImages(t *testing.T) {
+	is := assert.New(t)
+	var (
+		mu     sync.Mutex
+		pulled []string
+		loaded int
+	)
+	fc := &fakeClient{
+		imageInspectFunc: func(image string) (types.ImageInspect, []byte, error) {
+			return types.ImageInspect{}, nil, notFoundError("no such image")
+		},
+		imagePullFunc: func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			pulled = append(pulled, ref)
+			return emptyPull(ref, options)
+		},
+		imageLoadFunc: func(input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+			loaded++
+			return types.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetImageResolver(prependRegistry)
+	d.AddLocalImage("registry.example.com/cnab/db:1.0.0", makeTar(t, tarEntry{name: "manifest.json", content: "[]"}))
+
+	is.NoError(d.PullBundleImages(context.Background(), []string{"cnab/web:1.0.0", "cnab/db:1.0.0"}))
+	is.Equal([]string{"registry.example.com/cnab/web:1.0.0"}, pulled)
+	is.Equal(1, loaded)
+}
+
+func TestDockerDriver_Run_OperationLabels(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Labels = map[string]string{
+		"io.cnab.bundle.name": "helloworld",
+		DriverLabel:           "overridden",
+	}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.Equal(t, map[string]string{
+		"io.cnab.bundle.name": "helloworld",
+		DriverLabel:           "docker",
+	}, cfg.Labels)
+}
+
+func TestReadOutputs(t *testing.T) {
+	outputs, _, err := readOutputs(makeTar(t,
+		tarEntry{name: "outputs", dir: true},
+		tarEntry{name: "outputs/empty"},
+		tarEntry{name: "outputs/first", content: "1"},
+		tarEntry{name: "outputs/second", content: strings.Repeat("2", 3*outputsBufferSize)},
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"/cnab/app/outputs/empty":  "",
+		"/cnab/app/outputs/first":  "1",
+		"/cnab/app/outputs/second": strings.Repeat("2", 3*outputsBufferSize),
+	}, outputs)
+}
+
+func BenchmarkReadOutputs(b *testing.B) {
+	entries := []tarEntry{{name: "outputs", dir: true}}
+	for i := 0; i < 1000; i++ {
+		entries = append(entries, tarEntry{name: fmt.Sprintf("outputs/output-%d", i), content: fmt.Sprintf("value %d", i)})
+	}
+	archive := makeTar(b, entries...).Bytes()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := readOutputs(bytes.NewReader(archive)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestDockerDriver_SetMemoryReservation(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetMemory(1024 * 1024 * 1024)
+	d.SetMemoryReservation(256 * 1024 * 1024)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, int64(256*1024*1024), hostCfg.Resources.MemoryReservation)
+}
+
+func TestDockerDriver_SetMemoryReservation_GreaterThanMemory(t *testing.T) {
+	d := newFakeDockerDriver(newRunFakeClient())
+	d.SetMemory(512)
+	d.SetMemoryReservation(1024)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "memory reservation 1024 should be lower than or equal to the memory limit 512")
+}
+
+func TestDockerDriver_SetContainerStopTimeout(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	is.Nil(cfg.StopTimeout)
+
+	d.SetContainerStopTimeout(30)
+	cfg, _ = runConfigs(t, d, fc, testOperation())
+	if is.NotNil(cfg.StopTimeout) {
+		is.Equal(30, *cfg.StopTimeout)
+	}
+}
+
+func TestDockerDriver_SetSysctl(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	is.NoError(d.SetSysctl("net.core.somaxconn", "1024"))
+	is.NoError(d.SetSysctl("kernel.shmmax", "68719476736"))
+	is.NoError(d.SetSysctl("fs.mqueue.msg_max", "100"))
+	is.NoError(d.SetSysctl("net.core.somaxconn", "4096"))
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.Equal(map[string]string{
+		"net.core.somaxconn": "4096",
+		"kernel.shmmax":      "68719476736",
+		"fs.mqueue.msg_max":  "100",
+	}, hostCfg.Sysctls)
+}
+
+func TestDockerDriver_SetSysctl_NotNamespaced(t *testing.T) {
+	d := &DockerDriver{}
+	assert.EqualError(t, d.SetSysctl("kernel.pid_max", "65536"), "sysctl kernel.pid_max is not namespaced and cannot be set for a container")
+	assert.EqualError(t, d.SetSysctl("vm.swappiness", "10"), "sysctl vm.swappiness is not namespaced and cannot be set for a container")
+	assert.Nil(t, d.sysctls)
+}
+
+func TestDockerDriver_SetHardened(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetHardened(true)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.True(hostCfg.ReadonlyRootfs)
+	is.Equal(strslice.StrSlice{"ALL"}, hostCfg.CapDrop)
+	is.Contains(hostCfg.SecurityOpt, "no-new-privileges")
+	is.Equal([]mount.Mount{
+		{Type: mount.TypeTmpfs, Target: "/tmp"},
+		{Type: mount.TypeVolume, Target: "/cnab"},
+	}, hostCfg.Mounts)
+}
+
+func TestDockerDriver_SetHardened_Files(t *testing.T) {
+	is := assert.New(t)
+	var (
+		dest    string
+		names   []string
+		removed types.ContainerRemoveOptions
+	)
+	fc := newRunFakeClient()
+	fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+		dest = dstPath
+		tr := tar.NewReader(content)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			names = append(names, hdr.Name)
+		}
+		return nil
+	}
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		return ioutil.NopCloser(makeTar(t, tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"})), types.ContainerPathStat{}, nil
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		removed = options
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetHardened(true)
+	op := testOperation()
+	op.Files = map[string]string{"/cnab/app/image-map.json": "{}"}
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	// Docker only copies files into a read-only root file system below a volume.
+	is.Equal("/cnab", dest)
+	is.Equal([]string{"app/image-map.json"}, names)
+	is.Equal(map[string]string{"/cnab/app/outputs/kubeconfig": "apiVersion: v1"}, result.Outputs)
+	is.True(removed.RemoveVolumes, "the volume holding /cnab should be removed along with the container")
+}
+
+func TestDockerDriver_SetHardened_FileOutsideCnab(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created when a file cannot be copied")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetHardened(true)
+	op := testOperation()
+	op.Files = map[string]string{"/etc/app.conf": "debug = true"}
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "error staging files: file /etc/app.conf cannot be copied into a read-only root file system, only files below /cnab can")
+}
+
+func TestDockerDriver_SetHardened_Overridden(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetHardened(true)
+	d.AddConfigurationOptions(func(cfg *container.Config, hostCfg *container.HostConfig) error {
+		hostCfg.ReadonlyRootfs = false
+		hostCfg.CapDrop = []string{"NET_RAW"}
+		return nil
+	})
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.False(hostCfg.ReadonlyRootfs)
+	is.Equal(strslice.StrSlice{"NET_RAW"}, hostCfg.CapDrop)
+	is.Contains(hostCfg.SecurityOpt, "no-new-privileges")
+	// The outputs directory is writable along with the rest of the root file system.
+	is.Equal([]mount.Mount{{Type: mount.TypeTmpfs, Target: "/tmp"}}, hostCfg.Mounts)
+}
+
+func TestDockerDriver_SetIsolation(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	is.Equal(container.IsolationEmpty, hostCfg.Isolation)
+
+	is.NoError(d.SetIsolation("hyperv"))
+	_, hostCfg = runConfigs(t, d, fc, testOperation())
+	is.Equal(container.IsolationHyperV, hostCfg.Isolation)
+
+	is.NoError(d.SetIsolation("Process"))
+	_, hostCfg = runConfigs(t, d, fc, testOperation())
+	is.True(hostCfg.Isolation.IsProcess())
+}
+
+func TestDockerDriver_SetIsolation_Invalid(t *testing.T) {
+	d := &DockerDriver{}
+	assert.EqualError(t, d.SetIsolation("vm"), `unsupported isolation "vm", it should be one of default, process or hyperv`)
+	assert.Equal(t, container.IsolationEmpty, d.isolation)
+}
+
+func TestDockerDriver_SetOOMKillDisable(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetMemory(1024 * 1024 * 1024)
+	d.SetOOMKillDisable(true)
+	d.SetOOMScoreAdj(-500)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	if is.NotNil(hostCfg.Resources.OomKillDisable) {
+		is.True(*hostCfg.Resources.OomKillDisable)
+	}
+	is.Equal(-500, hostCfg.OomScoreAdj)
+}
+
+func TestDockerDriver_Run_OOMKillerUnsetByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	_, hostCfg := runConfigs(t, newFakeDockerDriver(fc), fc, testOperation())
+	assert.Nil(t, hostCfg.Resources.OomKillDisable)
+	assert.Equal(t, 0, hostCfg.OomScoreAdj)
+}
+
+func TestDockerDriver_SetSeccompProfileContent(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	profile := `{
+	"defaultAction": "SCMP_ACT_ERRNO",
+	"syscalls": [{"names": ["read", "write"], "action": "SCMP_ACT_ALLOW"}]
+}`
+	assert.NoError(t, d.SetSeccompProfileContent([]byte(profile)))
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, []string{
+		`seccomp={"defaultAction":"SCMP_ACT_ERRNO","syscalls":[{"names":["read","write"],"action":"SCMP_ACT_ALLOW"}]}`,
+	}, hostCfg.SecurityOpt)
+}
+
+func TestDockerDriver_SetSeccompProfileContent_Invalid(t *testing.T) {
+	d := &DockerDriver{}
+	assert.EqualError(t, d.SetSeccompProfileContent([]byte(`{"defaultAction": `)), "invalid seccomp profile: unexpected end of JSON input")
+}
+
+// execFakeClient returns a fakeClient on which the main process of a run exits with exitCode, and
+// the commands executed after it exit with execExitCode, writing output. The calls made are recorded
+// in events.
+//
+// Like Docker, it only executes commands in running containers: a container stops as soon as it
+// starts, unless its entrypoint keeps it running until it is stopped.
+func execFakeClient(exitCode int64, execExitCode int, output string, events *[]string) *fakeClient {
+	var (
+		mu        sync.Mutex
+		keepAlive bool
+		running   bool
+		execs     []string
+		exited    = make(chan struct{})
+	)
+	// stop is called with mu held.
+	stop := func() {
+		if running {
+			running = false
+			close(exited)
+		}
+	}
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		keepAlive = assert.ObjectsAreEqual(keepAliveEntrypoint, config.Entrypoint)
+		return container.ContainerCreateCreatedBody{ID: "test-container"}, nil
+	}
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*events = append(*events, "start "+containerID)
+		running = true
+		if !keepAlive {
+			// The main process of the container exits right away.
+			stop()
+		}
+		return nil
+	}
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		statusc := make(chan container.ContainerWaitOKBody, 1)
+		go func() {
+			<-exited
+			statusc <- container.ContainerWaitOKBody{StatusCode: exitCode}
+		}()
+		return statusc, make(chan error)
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*events = append(*events, "stop "+containerID)
+		stop()
+		return nil
+	}
+	fc.execCreateFunc = func(containerID string, config types.ExecConfig) (types.IDResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !running {
+			return types.IDResponse{}, fmt.Errorf("Error response from daemon: Container %s is not running", containerID)
+		}
+		*events = append(*events, fmt.Sprintf("exec %s %v", containerID, config.Cmd))
+		id := fmt.Sprintf("test-exec-%d", len(execs))
+		execs = append(execs, id)
+		return types.IDResponse{ID: id}, nil
+	}
+	// The first command executed is the main process of a container kept running.
+	isMain := func(execID string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return keepAlive && execID == execs[0]
+	}
+	fc.execAttachFunc = func(execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+		content := &bytes.Buffer{}
+		if !isMain(execID) {
+			fmt.Fprint(stdcopy.NewStdWriter(content, stdcopy.Stdout), output)
+		}
+		conn, _ := net.Pipe()
+		return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(content)}, nil
+	}
+	fc.execInspectFunc = func(execID string) (types.ContainerExecInspect, error) {
+		if isMain(execID) {
+			return types.ContainerExecInspect{ExecID: execID, ExitCode: int(exitCode)}, nil
+		}
+		return types.ContainerExecInspect{ExecID: execID, ExitCode: execExitCode}, nil
+	}
+	return fc
+}
+
+func TestDockerDriver_SetPostRunExec(t *testing.T) {
+	is := assert.New(t)
+	var events []string
+	fc := execFakeClient(0, 0, "cleaned up\n", &events)
+	d := newFakeDockerDriver(fc)
+	d.SetPostRunExec([]string{"/cnab/app/cleanup", "--all"})
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.ContainerOut = out
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.Equal(0, result.ExitCode)
+	is.Equal([]string{
+		"start test-container",
+		"exec test-container [/cnab/app/run]",
+		"exec test-container [/cnab/app/cleanup --all]",
+		"stop test-container",
+	}, events)
+	is.Equal("cleaned up\n", out.String())
+}
+
+func TestDockerDriver_SetPostRunExec_ImageCommand(t *testing.T) {
+	var events []string
+	fc := execFakeClient(0, 0, "", &events)
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{
+			ID:     "sha256:abc",
+			Config: &container.Config{Entrypoint: []string{"/entrypoint.sh"}, Cmd: []string{"install"}},
+		}, nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetPostRunExec([]string{"/cnab/app/cleanup"})
+	d.SetEntrypoint(ImageTypeDocker, nil)
+
+	_, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Contains(t, events, "exec test-container [/entrypoint.sh install]")
+}
+
+func TestDockerDriver_SetPostRunExec_Failure(t *testing.T) {
+	is := assert.New(t)
+	var events []string
+	d := newFakeDockerDriver(execFakeClient(0, 2, "", &events))
+	d.SetPostRunExec([]string{"/cnab/app/cleanup"})
+
+	_, err := d.Run(testOperation())
+	is.EqualError(err, "post-run command failed: exit code: 2")
+	is.Contains(events, "stop test-container")
+
+	// The post-run command also runs when the main process fails, whose error is returned.
+	events = nil
+	d = newFakeDockerDriver(execFakeClient(1, 2, "", &events))
+	d.SetPostRunExec([]string{"/cnab/app/cleanup"})
+	stderr := &bytes.Buffer{}
+	op := testOperation()
+	op.ContainerErr = stderr
+
+	_, err = d.Run(op)
+	is.EqualError(err, "container exit code: 1")
+	is.Len(events, 4)
+	is.Equal("post-run command failed: exit code: 2\n", stderr.String())
+}
+
+func TestDockerDriver_Run_ExitCodes(t *testing.T) {
+	is := assert.New(t)
+	for _, tc := range []struct {
+		code    int64
+		runtime bool
+	}{
+		{code: 1, runtime: false},
+		{code: 125, runtime: true},
+		{code: 126, runtime: true},
+		{code: 127, runtime: true},
+		{code: 137, runtime: false},
+	} {
+		fc := newRunFakeClient()
+		fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+			statusc := make(chan container.ContainerWaitOKBody, 1)
+			statusc <- container.ContainerWaitOKBody{StatusCode: tc.code}
+			return statusc, make(chan error)
+		}
+		d := newFakeDockerDriver(fc)
+
+		result, err := d.Run(testOperation())
+		is.EqualError(err, fmt.Sprintf("container exit code: %d", tc.code))
+		is.Equal(int(tc.code), result.ExitCode)
+		is.Equal(tc.runtime, errors.Is(err, ErrContainerRuntime), "exit code %d", tc.code)
+	}
+}
+
+func TestDockerDriver_SetExitCodeClassifier(t *testing.T) {
+	is := assert.New(t)
+	errNotReady := errors.New("the cluster is not ready")
+	classifier := func(code int) (bool, error) {
+		switch code {
+		case 0, 2:
+			return true, nil
+		case 3:
+			return false, errNotReady
+		}
+		return false, nil
+	}
+	for _, tc := range []struct {
+		code int64
+		err  string
+	}{
+		{code: 0},
+		{code: 2},
+		{code: 3, err: "the cluster is not ready"},
+		{code: 1, err: "container exit code: 1"},
+	} {
+		fc := newRunFakeClient()
+		fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+			statusc := make(chan container.ContainerWaitOKBody, 1)
+			statusc <- container.ContainerWaitOKBody{StatusCode: tc.code}
+			return statusc, make(chan error)
+		}
+		fetched := false
+		fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			fetched = true
+			outputs := makeTar(t,
+				tarEntry{name: "outputs", dir: true},
+				tarEntry{name: "outputs/report", content: "healthy"},
+			)
+			return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+		}
+		d := newFakeDockerDriver(fc)
+		d.SetExitCodeClassifier(classifier)
+
+		result, err := d.Run(testOperation())
+		is.Equal(int(tc.code), result.ExitCode)
+		if tc.err != "" {
+			is.EqualError(err, tc.err, "exit code %d", tc.code)
+			is.False(fetched, "exit code %d", tc.code)
+			continue
+		}
+		is.NoError(err, "exit code %d", tc.code)
+		is.True(fetched, "exit code %d", tc.code)
+		is.Equal(map[string]string{"/cnab/app/outputs/report": "healthy"}, result.Outputs)
+	}
+}
+
+func TestDockerDriver_SetStatsHandler(t *testing.T) {
+	is := assert.New(t)
+	now := time.Now().UTC()
+	fc := newRunFakeClient()
+	fc.containerStatsFunc = func(containerID string, stream bool) (types.ContainerStats, error) {
+		is.Equal("test-container", containerID)
+		is.True(stream)
+		body := &bytes.Buffer{}
+		enc := json.NewEncoder(body)
+		var first, second types.StatsJSON
+		first.Read = now
+		first.CPUStats = types.CPUStats{CPUUsage: types.CPUUsage{TotalUsage: 100}, SystemUsage: 1000, OnlineCPUs: 2}
+		first.MemoryStats = types.MemoryStats{Usage: 1024, Limit: 4096}
+		second.Read = now.Add(time.Second)
+		second.PreCPUStats = first.CPUStats
+		second.CPUStats = types.CPUStats{CPUUsage: types.CPUUsage{TotalUsage: 300}, SystemUsage: 2000, OnlineCPUs: 2}
+		second.MemoryStats = types.MemoryStats{Usage: 2048, Limit: 4096}
+		is.NoError(enc.Encode(first))
+		is.NoError(enc.Encode(second))
+		return types.ContainerStats{Body: ioutil.NopCloser(body)}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	var samples []StatsSample
+	d.SetStatsHandler(func(s StatsSample) {
+		samples = append(samples, s)
+	})
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal([]StatsSample{
+		{Time: now, CPUPercent: 0, MemoryUsage: 1024, MemoryLimit: 4096},
+		{Time: now.Add(time.Second), CPUPercent: 40, MemoryUsage: 2048, MemoryLimit: 4096},
+	}, samples)
+}
+
+func TestDockerDriver_SetWorkingDir_RelativeFiles(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	is.NoError(d.SetWorkingDir("/cnab/app"))
+	op := testOperation()
+	op.Files = map[string]string{
+		"config.yaml":          "config",
+		"../secrets/token":     "token",
+		"/home/user/.kubeconf": "kubeconfig",
+	}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	is.Equal("/cnab/app", cfg.WorkingDir)
+	copied := copiedFiles(t, d, fc, op)
+	is.Len(copied, 3)
+	is.Contains(copied, "/cnab/app/config.yaml")
+	is.Contains(copied, "/cnab/secrets/token")
+	is.Contains(copied, "/home/user/.kubeconf")
+}
+
+func TestDockerDriver_Run_CollidingFiles(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created when files collide")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	assert.NoError(t, d.SetWorkingDir("/cnab/app"))
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config.yaml": "from a credential",
+		"config.yaml":           "from a parameter",
+	}
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "error staging files: files /cnab/app/config.yaml and config.yaml are both injected at /cnab/app/config.yaml")
+}
+
+func TestDockerDriver_Run_FileCollidingWithRunContext(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created when files collide")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetInjectRunContext(true)
+	op := testOperation()
+	op.Files = map[string]string{"/cnab/app/run-context.json": "{}"}
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "file /cnab/app/run-context.json collides with the run context")
+}
+
+func TestDockerDriver_Run_RelativeFilesWithoutWorkingDir(t *testing.T) {
+	d := newFakeDockerDriver(newRunFakeClient())
+	op := testOperation()
+	op.Files = map[string]string{"config.yaml": "config"}
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "error staging files: destination path config.yaml should be an absolute unix path")
+}
+
+func TestDockerDriver_SetWorkingDir_Relative(t *testing.T) {
+	d := &DockerDriver{}
+	assert.EqualError(t, d.SetWorkingDir("app"), "working directory app should be an absolute unix path")
+}
+
+func TestDockerDriver_Run_RetriesCreateAfterPull(t *testing.T) {
+	is := assert.New(t)
+	creates := 0
+	pulled := false
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		creates++
+		switch creates {
+		case 1:
+			return container.ContainerCreateCreatedBody{}, notFoundError("No such image: example.com/test:1.2.3")
+		case 2:
+			return container.ContainerCreateCreatedBody{}, errors.New("error creating overlay mount: device or resource busy")
+		}
+		return container.ContainerCreateCreatedBody{ID: "test-container"}, nil
+	}
+	fc.imagePullFunc = func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+		pulled = true
+		return emptyPull(ref, options)
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetStartRetry(3, time.Millisecond)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.True(pulled)
+	is.Equal(3, creates)
+}
+
+func TestDockerDriver_SetHostname(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	assert.NoError(t, d.SetHostname("node-1.cluster.local"))
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, "node-1.cluster.local", cfg.Hostname)
+}
+
+func TestDockerDriver_SetHostname_Invalid(t *testing.T) {
+	d := &DockerDriver{}
+	for _, hostname := range []string{"", "-node", "node-", "node_1", "node..local", strings.Repeat("a", 64)} {
+		assert.EqualError(t, d.SetHostname(hostname), fmt.Sprintf("invalid hostname %q", hostname))
+	}
+}
+
+func TestDockerDriver_ListOutputs(t *testing.T) {
+	is := assert.New(t)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "outputs", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "outputs/kubeconfig", Mode: 0600, Size: 14, Typeflag: tar.TypeReg},
+		{Name: "outputs/nested", Mode: 0755, Typeflag: tar.TypeDir},
+		{Name: "outputs/nested/report", Mode: 0644, Size: 2048, Typeflag: tar.TypeReg},
+	} {
+		is.NoError(tw.WriteHeader(hdr))
+		_, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+		is.NoError(err)
+	}
+	is.NoError(tw.Close())
+	fc := &fakeClient{
+		copyFromContainerFunc: func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+			is.Equal("test-container", containerID)
+			is.Equal("/cnab/app/outputs", srcPath)
+			return ioutil.NopCloser(buf), types.ContainerPathStat{}, nil
+		},
+	}
+	d := newFakeDockerDriver(fc)
+
+	infos, err := d.ListOutputs(context.Background(), "test-container")
+	is.NoError(err)
+	is.Equal([]OutputInfo{
+		{Path: "/cnab/app/outputs/kubeconfig", Size: 14, Mode: 0600},
+		{Path: "/cnab/app/outputs/nested/report", Size: 2048, Mode: 0644},
+	}, infos)
+}
+
+func TestReadOutputs_PathTraversal(t *testing.T) {
+	for _, entry := range []string{
+		"outputs/../../../etc/passwd",
+		"outputs/../run",
+		"../outputs-sibling/file",
+		"/etc/passwd",
+		"other/file",
+	} {
+		outputs, _, err := readOutputs(makeTar(t,
+			tarEntry{name: "outputs/first", content: "1"},
+			tarEntry{name: entry, content: "evil"},
+		))
+		assert.EqualError(t, err, fmt.Sprintf("output %s is outside of /cnab/app/outputs", entry))
+		assert.True(t, errors.Is(err, ErrUnsafeOutputPath))
+		assert.Equal(t, map[string]string{"/cnab/app/outputs/first": "1"}, outputs)
+	}
+}
+
+func TestDockerDriver_Run_RejectsOutputPathTraversal(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		return ioutil.NopCloser(makeTar(t, tarEntry{name: "outputs/../../../root/.ssh/authorized_keys", content: "evil"})), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	assert.True(t, errors.Is(err, ErrUnsafeOutputPath))
+}
+
+func TestDockerDriver_SetLastRunHash_Unchanged(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("an unchanged operation should not be run")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	hash, err := op.Hash()
+	is.NoError(err)
+	d.SetLastRunHash(hash)
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.True(result.Unchanged)
+}
+
+func TestDockerDriver_SetLastRunHash_Changed(t *testing.T) {
+	is := assert.New(t)
+	var created bool
+	fc := newRunFakeClient()
+	create := fc.containerCreateFunc
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		created = true
+		return create(config, hostConfig)
+	}
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	hash, err := op.Hash()
+	is.NoError(err)
+	d.SetLastRunHash(hash)
+	op.Parameters = map[string]interface{}{"replicas": 2}
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.False(result.Unchanged)
+	is.True(created)
+}
+
+func TestDockerDriver_Run_WaitStatusAndError(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		statusc := make(chan container.ContainerWaitOKBody, 1)
+		errc := make(chan error, 1)
+		statusc <- container.ContainerWaitOKBody{StatusCode: 0}
+		errc <- errors.New("unexpected EOF")
+		return statusc, errc
+	}
+	d := newFakeDockerDriver(fc)
+
+	// Whichever channel is received from first, the error is not dropped.
+	for i := 0; i < 20; i++ {
+		_, err := d.Run(testOperation())
+		assert.EqualError(t, err, "error in container: unexpected EOF")
+	}
+}
+
+func TestDockerDriver_Run_WaitErrorChannelClosed(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		statusc := make(chan container.ContainerWaitOKBody)
+		errc := make(chan error)
+		go func() {
+			close(errc)
+			statusc <- container.ContainerWaitOKBody{StatusCode: 3}
+		}()
+		return statusc, errc
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.EqualError(err, "container exit code: 3")
+	is.Equal(3, result.ExitCode)
+}
+
+func TestDockerDriver_Run_WaitDoesNotLeakOnEarlyReturn(t *testing.T) {
+	sent := make(chan struct{})
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		// Like the Docker client, the status is sent on an unbuffered channel.
+		statusc := make(chan container.ContainerWaitOKBody)
+		go func() {
+			defer close(sent)
+			statusc <- container.ContainerWaitOKBody{StatusCode: 0}
+		}()
+		return statusc, make(chan error, 1)
+	}
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		return errors.New("Error response from daemon: OCI runtime create failed")
+	}
+	d := newFakeDockerDriver(fc)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "cannot start container: Error response from daemon: OCI runtime create failed")
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the status of the container was never received")
+	}
+}
+
+func TestDockerDriver_SetForceRemove(t *testing.T) {
+	is := assert.New(t)
+	var (
+		events  []string
+		handled []string
+	)
+	fc := newRunFakeClient()
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		events = append(events, fmt.Sprintf("stop %s %s", containerID, *timeout))
+		return nil
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		events = append(events, fmt.Sprintf("remove %s force=%t", containerID, options.Force))
+		return errors.New("removal of container test-container is already in progress")
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetForceRemove(true)
+	d.SetRemoveGrace(5 * time.Second)
+	d.SetRemoveErrorHandler(func(containerID string, err error) {
+		handled = append(handled, fmt.Sprintf("%s: %v", containerID, err))
+	})
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	// The container is known to have exited, it is not stopped.
+	is.Equal([]string{"remove test-container force=true"}, events)
+
+	events = nil
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		return errors.New("Error response from daemon: OCI runtime create failed")
+	}
+	_, err = d.Run(testOperation())
+	is.Error(err)
+	is.Equal([]string{"stop test-container 5s", "remove test-container force=true"}, events)
+	is.Equal([]string{
+		"test-container: removal of container test-container is already in progress",
+		"test-container: removal of container test-container is already in progress",
+	}, handled)
+}
+
+func TestDockerDriver_Run_LogsRemoveErrors(t *testing.T) {
+	is := assert.New(t)
+	var force bool
+	fc := newRunFakeClient()
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		force = options.Force
+		return errors.New("You cannot remove a running container test-container")
+	}
+	d := newFakeDockerDriver(fc)
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.Out = out
+
+	_, err := d.Run(op)
+	is.NoError(err)
+	is.False(force)
+	is.Equal("cannot remove container test-container: You cannot remove a running container test-container\n", out.String())
+}
+
+const (
+	testDigest  = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	otherDigest = "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+)
+
+func digestFakeClient(repoDigests ...string) *fakeClient {
+	fc := newRunFakeClient()
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		return types.ImageInspect{RepoDigests: repoDigests}, nil, nil
+	}
+	return fc
+}
+
+func TestDockerDriver_Run_VerifiesDigest(t *testing.T) {
+	fc := digestFakeClient("example.com/other@"+otherDigest, "example.com/test@"+testDigest)
+	d := newFakeDockerDriver(fc)
+	d.SetRequireDigest(true)
+	op := testOperation()
+	op.Image = "example.com/test@" + testDigest
+
+	_, err := d.Run(op)
+	assert.NoError(t, err)
+}
+
+func TestDockerDriver_Run_DigestMismatch(t *testing.T) {
+	fc := digestFakeClient("example.com/test@"+otherDigest, "example.com/other@"+testDigest)
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Image = "example.com/test@" + testDigest
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "image example.com/test@"+testDigest+" does not match its digest, its digests are: "+
+		"example.com/test@"+otherDigest+", example.com/other@"+testDigest)
+}
+
+func TestDockerDriver_SetRequireDigest_Tag(t *testing.T) {
+	fc := digestFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created for an image referenced by tag")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRequireDigest(true)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "image example.com/test:1.2.3 should be referenced by digest")
+}
+
+func TestDockerDriver_SetFetchOutputs_Disabled(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		t.Fatal("outputs should not be copied when fetching them is disabled")
+		return nil, types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetFetchOutputs(false)
+
+	result, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Nil(t, result.Outputs)
+}
+
+func TestDockerDriver_SetInjectRunContext(t *testing.T) {
+	is := assert.New(t)
+	var rc RunContext
+	fc := newRunFakeClient()
+	fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+		tr := tar.NewReader(content)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			if hdr.Name == "/cnab/app/run-context.json" {
+				is.NoError(json.NewDecoder(tr).Decode(&rc))
+			}
+		}
+		_, err := io.Copy(ioutil.Discard, content)
+		return err
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetInjectRunContext(true)
+	op := testOperation()
+	op.Revision = "01D1Y8ZJ9ZTWR6KHTX0NM8SVSD"
+	op.Files["/cnab/app/config"] = "content"
+	before := time.Now()
+
+	_, err := d.Run(op)
+	is.NoError(err)
+	is.Equal("install", rc.Action)
+	is.Equal("test", rc.Installation)
+	is.Equal("01D1Y8ZJ9ZTWR6KHTX0NM8SVSD", rc.Revision)
+	is.WithinDuration(before, rc.Timestamp, time.Minute)
+	// The files of the operation are left untouched.
+	is.Equal(map[string]string{"/cnab/app/config": "content"}, op.Files)
+}
+
+func TestDockerDriver_Run_NoRunContextByDefault(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	headers := copiedFiles(t, d, fc, testOperation())
+	assert.NotContains(t, headers, "/cnab/app/run-context.json")
+}
+
+func TestDockerDriver_Run_OutputsMount(t *testing.T) {
+	is := assert.New(t)
+	base, err := ioutil.TempDir("", "outputs-mount")
+	is.NoError(err)
+	defer os.RemoveAll(base)
+
+	var outputs mount.Mount
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		is.Len(hostConfig.Mounts, 1)
+		outputs = hostConfig.Mounts[0]
+		return container.ContainerCreateCreatedBody{ID: "test-container"}, nil
+	}
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		// The invocation image writes its outputs to the mounted directory.
+		is.NoError(os.MkdirAll(filepath.Join(outputs.Source, "nested"), 0755))
+		is.NoError(ioutil.WriteFile(filepath.Join(outputs.Source, "kubeconfig"), []byte("apiVersion: v1"), 0644))
+		is.NoError(ioutil.WriteFile(filepath.Join(outputs.Source, "nested", "token"), []byte("secret"), 0644))
+		return nil
+	}
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		t.Fatal("outputs should not be copied from the container when the outputs directory is mounted")
+		return nil, types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetConfig(map[string]string{"OUTPUTS_MOUNT_PATH": base})
+
+	result, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal(mount.TypeBind, outputs.Type)
+	is.Equal("/cnab/app/outputs", outputs.Target)
+	is.Equal(base, filepath.Dir(outputs.Source))
+	is.Equal(map[string]string{
+		"/cnab/app/outputs/kubeconfig":   "apiVersion: v1",
+		"/cnab/app/outputs/nested/token": "secret",
+	}, result.Outputs)
+
+	// The temporary directory is removed once the outputs are read.
+	entries, err := ioutil.ReadDir(base)
+	is.NoError(err)
+	is.Empty(entries)
+}
+
+func TestDockerDriver_Run_OutputsMountCleanedUpOnFailure(t *testing.T) {
+	is := assert.New(t)
+	base, err := ioutil.TempDir("", "outputs-mount")
+	is.NoError(err)
+	defer os.RemoveAll(base)
+
+	fc := newRunFakeClient()
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		statusc := make(chan container.ContainerWaitOKBody, 1)
+		statusc <- container.ContainerWaitOKBody{StatusCode: 1}
+		return statusc, make(chan error)
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetConfig(map[string]string{"OUTPUTS_MOUNT_PATH": base})
+
+	result, err := d.Run(testOperation())
+	is.EqualError(err, "container exit code: 1")
+	is.Nil(result.Outputs)
+	entries, err := ioutil.ReadDir(base)
+	is.NoError(err)
+	is.Empty(entries)
+}
+
+func TestDockerDriver_SetLogConfig(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetLogConfig("json-file", map[string]string{"max-size": "10m", "max-file": "3"})
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, container.LogConfig{
+		Type:   "json-file",
+		Config: map[string]string{"max-size": "10m", "max-file": "3"},
+	}, hostCfg.LogConfig)
+}
+
+func TestDockerDriver_SetLogConfig_UnreadableDriver(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	attach := fc.containerAttachFunc
+	fc.containerAttachFunc = func(containerID string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+		is.False(options.Logs)
+		return attach(containerID, options)
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetLogConfig("fluentd", map[string]string{"fluentd-address": "localhost:24224"})
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+
+	d.SetLogOptions("100", 0)
+	_, err = d.Run(testOperation())
+	is.EqualError(err, "logs cannot be read from the fluentd logging driver, log options cannot be used")
+}
+
+func testBundle() *bundle.Bundle {
+	return &bundle.Bundle{
+		Name:     "test",
+		Version:  "0.1.0",
+		Keywords: []string{"kubernetes"},
+		Outputs: map[string]bundle.OutputDefinition{
+			"kubeconfig": {Path: "/cnab/app/outputs/kubeconfig"},
+			"token":      {Path: "/cnab/app/outputs/token", ApplyTo: []string{"install"}},
+			"report":     {Path: "/cnab/app/outputs/report", ApplyTo: []string{"status"}},
+		},
+	}
+}
+
+func TestDockerDriver_Run_BundleLabels(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetFetchOutputs(false)
+	op := testOperation()
+	op.Bundle = testBundle()
+	op.Labels = map[string]string{"io.cnab.bundle.version": "0.1.0-rc1", "team": "platform"}
+
+	cfg, _ := runConfigs(t, d, fc, op)
+	assert.Equal(t, map[string]string{
+		"io.cnab.bundle.name":     "test",
+		"io.cnab.bundle.version":  "0.1.0-rc1",
+		"io.cnab.bundle.keywords": "kubernetes",
+		"team":                    "platform",
+		"io.cnab.driver":          "docker",
+	}, cfg.Labels)
+}
+
+func TestDockerDriver_Run_DeclaredOutputs(t *testing.T) {
+	is := assert.New(t)
+	outputs := []tarEntry{{name: "outputs/kubeconfig", content: "apiVersion: v1"}}
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		return ioutil.NopCloser(makeTar(t, outputs...)), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Bundle = testBundle()
+
+	_, err := d.Run(op)
+	is.EqualError(err, "outputs declared by the bundle were not produced: token")
+
+	outputs = append(outputs, tarEntry{name: "outputs/token", content: "secret"})
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.Len(result.Outputs, 2)
+
+	// Outputs of other actions are not expected.
+	op.Action = "upgrade"
+	outputs = outputs[:1]
+	_, err = d.Run(op)
+	is.NoError(err)
+}
+
+func TestDockerDriver_SetRuntime(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.info.Runtimes = map[string]types.Runtime{"runc": {Path: "runc"}, "runsc": {Path: "/usr/local/bin/runsc"}}
+	d := newFakeDockerDriver(fc)
+	d.SetRuntime("runsc")
+	d.SetVerifyRuntime(true)
+
+	_, hostCfg := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, "runsc", hostCfg.Runtime)
+}
+
+func TestDockerDriver_SetVerifyRuntime_Unregistered(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.info.Runtimes = map[string]types.Runtime{"runc": {Path: "runc"}, "nvidia": {Path: "nvidia-container-runtime"}}
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created with an unregistered runtime")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRuntime("kata-runtime")
+	d.SetVerifyRuntime(true)
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "runtime kata-runtime is not registered with the Docker daemon, available runtimes: nvidia, runc")
+}
+
+func TestDockerDriver_AddLocalImage(t *testing.T) {
+	is := assert.New(t)
+	var loaded []string
+	fc := newRunFakeClient()
+	fc.imageLoadFunc = func(input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+		tr := tar.NewReader(input)
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				break
+			}
+			loaded = append(loaded, hdr.Name)
+		}
+		return types.ImageLoadResponse{
+			Body: ioutil.NopCloser(strings.NewReader(`{"stream":"Loaded image: example.com/test:1.2.3\n"}`)),
+			JSON: true,
+		}, nil
+	}
+	fc.imagePullFunc = func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+		t.Fatal("a local image should not be pulled")
+		return nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetConfig(map[string]string{"PULL_ALWAYS": "1"})
+	d.AddLocalImage("example.com/test:1.2.3", makeTar(t,
+		tarEntry{name: "manifest.json", content: "[]"},
+		tarEntry{name: "repositories", content: "{}"},
+	))
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal([]string{"manifest.json", "repositories"}, loaded)
+}
+
+func TestDockerDriver_AddLocalImage_ConcurrentRuns(t *testing.T) {
+	is := assert.New(t)
+	var (
+		mu     sync.Mutex
+		loaded int
+	)
+	fc := newRunFakeClient()
+	fc.imageLoadFunc = func(input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+		mu.Lock()
+		loaded++
+		mu.Unlock()
+		return types.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.AddLocalImage("example.com/test:1.2.3", makeTar(t, tarEntry{name: "manifest.json", content: "[]"}))
+	d.AddLocalImage("example.com/other:1.2.3", makeTar(t, tarEntry{name: "manifest.json", content: "[]"}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		op := testOperation()
+		if i%2 == 1 {
+			op.Image = "example.com/other:1.2.3"
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.Run(op)
+			is.NoError(err)
+		}()
+	}
+	wg.Wait()
+	is.Equal(2, loaded, "each archive should be loaded once")
+}
+
+func TestDockerDriver_AddLocalImage_LoadError(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.imageLoadFunc = func(input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+		return types.ImageLoadResponse{
+			Body: ioutil.NopCloser(strings.NewReader(`{"errorDetail":{"message":"unexpected EOF"},"error":"unexpected EOF"}`)),
+			JSON: true,
+		}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.AddLocalImage("example.com/test:1.2.3", strings.NewReader("not an archive"))
+
+	_, err := d.Run(testOperation())
+	assert.EqualError(t, err, "cannot load image example.com/test:1.2.3: unexpected EOF")
+}
+
+func TestDockerDriver_Run_PartialOutputs(t *testing.T) {
+	is := assert.New(t)
+	archive := makeTar(t,
+		tarEntry{name: "outputs/first", content: "1"},
+		tarEntry{name: "outputs/second", content: strings.Repeat("2", 100)},
+	).Bytes()
+	fc := newRunFakeClient()
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		// The stream is cut in the middle of the content of the second output.
+		return ioutil.NopCloser(bytes.NewReader(archive[:3*512+10])), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	is.EqualError(err, "error reading output /cnab/app/outputs/second: unexpected EOF")
+	is.Equal(map[string]string{"/cnab/app/outputs/first": "1"}, result.Outputs)
+	is.Equal(map[string]OutputStatus{
+		"/cnab/app/outputs/first":  {Status: OutputFetched},
+		"/cnab/app/outputs/second": {Status: OutputFailed, Error: "unexpected EOF"},
+	}, result.OutputStatuses)
+}
+
+func TestReadOutputsDir_PartialFailure(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read files regardless of their permissions")
+	}
+	is := assert.New(t)
+	dir, err := ioutil.TempDir("", "outputs")
+	is.NoError(err)
+	defer os.RemoveAll(dir)
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "first"), []byte("1"), 0644))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "second"), []byte("2"), 0000))
+	is.NoError(ioutil.WriteFile(filepath.Join(dir, "third"), []byte("3"), 0644))
+
+	outputs, statuses, err := readOutputsDir(dir)
+	is.Error(err)
+	is.Equal(map[string]string{
+		"/cnab/app/outputs/first": "1",
+		"/cnab/app/outputs/third": "3",
+	}, outputs)
+	is.Equal(OutputFetched, statuses["/cnab/app/outputs/first"].Status)
+	is.Equal(OutputFailed, statuses["/cnab/app/outputs/second"].Status)
+	is.Contains(statuses["/cnab/app/outputs/second"].Error, "permission denied")
+	is.Equal(OutputFetched, statuses["/cnab/app/outputs/third"].Status)
+}
+
+func TestDockerDriver_Run_StopsContainerOnEarlyReturn(t *testing.T) {
+	is := assert.New(t)
+	var events []string
+	fc := newRunFakeClient()
+	fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+		return errors.New("Error response from daemon: container test-container is being created")
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		events = append(events, fmt.Sprintf("stop %s %s", containerID, *timeout))
+		return nil
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		events = append(events, "remove "+containerID)
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.Out = out
+
+	_, err := d.Run(op)
+	is.EqualError(err, "error copying to / in container: Error response from daemon: container test-container is being created")
+	is.Equal([]string{"stop test-container 10s", "remove test-container"}, events)
+	is.Empty(out.String())
+}
+
+func TestDockerDriver_Run_CleanupIgnoresRemovedContainers(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		return errors.New("Error response from daemon: OCI runtime create failed")
+	}
+	fc.containerStopFunc = func(containerID string, timeout *time.Duration) error {
+		return notFoundError("No such container: test-container")
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		return notFoundError("No such container: test-container")
+	}
+	d := newFakeDockerDriver(fc)
+	out := &bytes.Buffer{}
+	op := testOperation()
+	op.Out = out
+
+	_, err := d.Run(op)
+	assert.Error(t, err)
+	assert.Empty(t, out.String())
+}
+
+func TestDockerDriver_SetRunManifest(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.imageInspectFunc = func(image string) (types.ImageInspect, []byte, error) {
+		is.Equal("example.com/test:1.2.3", image)
+		return types.ImageInspect{
+			ID:          "sha256:4bf92f3577b34da6a3ce929d0e0e4736",
+			RepoDigests: []string{"example.com/test@" + testDigest},
+		}, nil, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetRunManifest(true)
+	d.SetPrivileged(true)
+	d.SetCmd([]string{"--verbose"})
+	d.AddVolume("cache", "/cache", true)
+	fc.volumeInspectFunc = func(volumeID string) (types.Volume, error) {
+		return types.Volume{Name: volumeID}, nil
+	}
+	op := testOperation()
+	op.Environment = map[string]string{"CNAB_ACTION": "install", "SECRET": "hunter2"}
+	op.Files["/cnab/app/config"] = "hello"
+	op.Files["/cnab/app/credentials/password"] = "hunter2"
+	op.FileModes = map[string]os.FileMode{"/cnab/app/credentials/password": 0600}
+
+	result, err := d.Run(op)
+	is.NoError(err)
+	is.Equal(&RunManifest{
+		Image:       "example.com/test:1.2.3",
+		ImageID:     "sha256:4bf92f3577b34da6a3ce929d0e0e4736",
+		RepoDigests: []string{"example.com/test@" + testDigest},
+		Entrypoint:  []string{"/cnab/app/run"},
+		Cmd:         []string{"--verbose"},
+		EnvKeys:     []string{"CNAB_ACTION", "SECRET"},
+		Files: map[string]RunManifestFile{
+			"/cnab/app/config": {
+				SHA256: "sha256:2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+				Mode:   0644,
+			},
+			"/cnab/app/credentials/password": {SHA256: "redacted", Mode: 0600},
+		},
+		Host: RunManifestHost{
+			Privileged: true,
+			Mounts:     []string{"cache:/cache:ro"},
+		},
+	}, result.RunManifest)
+
+	data, err := json.Marshal(result.RunManifest)
+	is.NoError(err)
+	is.NotContains(string(data), "hunter2")
+	is.Contains(string(data), "/cnab/app/credentials/password")
+	is.NotContains(string(data), "f52fbd32b2b3b86ff88ef6c490628285f482af15ddcb29541f94bcf526a3f6c7")
+}
+
+func TestDockerDriver_Run_NoRunManifestByDefault(t *testing.T) {
+	result, err := newFakeDockerDriver(newRunFakeClient()).Run(testOperation())
+	assert.NoError(t, err)
+	assert.Nil(t, result.RunManifest)
+}
+
+func TestDockerDriver_Run_FileModes(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	op := testOperation()
+	op.Files = map[string]string{
+		"/cnab/app/config":     "config",
+		"/home/user/.kubeconf": "kubeconfig",
+	}
+	op.FileModes = map[string]os.FileMode{"/home/user/.kubeconf": 0600}
+
+	headers := copiedFiles(t, d, fc, op)
+	is.Equal(int64(0644), headers["/cnab/app/config"].Mode)
+	is.Equal(int64(0600), headers["/home/user/.kubeconf"].Mode)
+}
+
+func TestDockerDriver_SetEntrypoint(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetEntrypoint(ImageTypeOCI, []string{"/cnab/app/oci-run", "--strict"})
+
+	testcases := []struct {
+		imageType  string
+		entrypoint strslice.StrSlice
+	}{
+		{imageType: ImageTypeDocker, entrypoint: strslice.StrSlice{"/cnab/app/run"}},
+		{imageType: ImageTypeOCI, entrypoint: strslice.StrSlice{"/cnab/app/oci-run", "--strict"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.imageType, func(t *testing.T) {
+			op := testOperation()
+			op.ImageType = tc.imageType
+			cfg, _ := runConfigs(t, d, fc, op)
+			assert.Equal(t, tc.entrypoint, cfg.Entrypoint)
+		})
+	}
+}
+
+func TestDockerDriver_SetEntrypoint_DockerOverride(t *testing.T) {
+	fc := newRunFakeClient()
+	d := newFakeDockerDriver(fc)
+	d.SetEntrypoint(ImageTypeDocker, []string{"/usr/local/bin/run"})
+
+	cfg, _ := runConfigs(t, d, fc, testOperation())
+	assert.Equal(t, strslice.StrSlice{"/usr/local/bin/run"}, cfg.Entrypoint)
+}
+
+func TestDockerDriver_SetDebugShell(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	var cfg *container.Config
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		cfg = config
+		return container.ContainerCreateCreatedBody{ID: "test-container"}, nil
+	}
+	fc.containerRemoveFunc = func(containerID string, options types.ContainerRemoveOptions) error {
+		t.Fatal("the container should be kept when debugging")
+		return nil
+	}
+	fc.containerWaitFunc = func(containerID string, condition container.WaitCondition) (<-chan container.ContainerWaitOKBody, <-chan error) {
+		t.Fatal("the container should not be waited for when debugging")
+		return nil, nil
+	}
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		t.Fatal("outputs should not be fetched when debugging")
+		return nil, types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetDebugShell(true)
+	d.SetCmd([]string{"--verbose"})
+	op := testOperation()
+	out := &bytes.Buffer{}
+	op.Out = out
+
+	_, err := d.Run(op)
+	is.NoError(err)
+	is.Equal(strslice.StrSlice{"/bin/sh", "-c", "tail -f /dev/null"}, cfg.Entrypoint)
+	is.Empty(cfg.Cmd)
+	is.Contains(out.String(), "docker exec -it test-container /bin/sh")
+	is.Contains(out.String(), "docker rm -f test-container")
+}
+
+func TestDockerDriver_SetUploadProgress(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	var copied int64
+	fc.copyToContainerFunc = func(containerID, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+		// Read in small chunks, so that progress is reported several times.
+		buf := make([]byte, 512)
+		for {
+			n, err := content.Read(buf)
+			copied += int64(n)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	d := newFakeDockerDriver(fc)
+	var reports [][2]int64
+	d.SetUploadProgress(func(copied, total int64) {
+		reports = append(reports, [2]int64{copied, total})
+	})
+	op := testOperation()
+	op.Files["/cnab/app/big"] = strings.Repeat("x", 10*1024)
+
+	_, err := d.Run(op)
+	is.NoError(err)
+	is.True(len(reports) > 1, "progress should be reported several times")
+	for i, r := range reports {
+		is.Equal(copied, r[1], "the total should be the size of the archive")
+		if i > 0 {
+			is.True(r[0] > reports[i-1][0], "the copied bytes should increase")
+		}
+	}
+	is.Equal(copied, reports[len(reports)-1][0])
+}
+
+func TestDockerDriver_SetOnContainerCreated(t *testing.T) {
+	is := assert.New(t)
+	var calls []string
+	fc := newRunFakeClient()
+	fc.containerStartFunc = func(containerID string, options types.ContainerStartOptions) error {
+		calls = append(calls, "start "+containerID)
+		return nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetOnContainerCreated(func(id string) {
+		calls = append(calls, "created "+id)
+	})
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+	is.Equal([]string{"created test-container", "start test-container"}, calls)
+}
+
+func TestDockerDriver_SetEventLog(t *testing.T) {
+	is := assert.New(t)
+	fc := digestFakeClient("example.com/other@"+otherDigest, "example.com/test@"+testDigest)
+	fc.copyFromContainerFunc = func(containerID, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+		outputs := makeTar(t,
+			tarEntry{name: "outputs", dir: true},
+			tarEntry{name: "outputs/token", content: "secret"},
+			tarEntry{name: "outputs/kubeconfig", content: "apiVersion: v1"},
+		)
+		return ioutil.NopCloser(outputs), types.ContainerPathStat{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	log := &bytes.Buffer{}
+	d.SetEventLog(log)
+
+	_, err := d.Run(testOperation())
+	is.NoError(err)
+
+	var events []Event
+	dec := json.NewDecoder(log)
+	for dec.More() {
+		var e Event
+		is.NoError(dec.Decode(&e))
+		is.Equal("install", e.Action)
+		is.Equal("test", e.Installation)
+		is.False(e.Time.IsZero())
+		events = append(events, e)
+	}
+	var kinds []string
+	for _, e := range events {
+		kinds = append(kinds, e.Type)
+	}
+	is.Equal([]string{
+		EventRunStarted,
+		EventImagePullSkipped,
+		EventContainerCreated,
+		EventImageResolved,
+		EventContainerStarted,
+		EventContainerExited,
+		EventOutputsFetched,
+		EventRunFinished,
+	}, kinds)
+	is.Equal("example.com/test:1.2.3", events[0].Image)
+	is.Equal("example.com/test:1.2.3", events[1].Image)
+	is.Equal("test-container", events[2].ContainerID)
+	is.Equal(testDigest, events[3].ImageDigest)
+	if is.NotNil(events[5].ExitCode) {
+		is.Equal(0, *events[5].ExitCode)
+	}
+	is.Equal([]string{"/cnab/app/outputs/kubeconfig", "/cnab/app/outputs/token"}, events[6].Outputs)
+	is.Empty(events[7].Error)
+}
+
+// eventTypes runs op on d and returns the types of the events it logged.
+func eventTypes(t *testing.T, d *DockerDriver, op *Operation) []string {
+	log := &bytes.Buffer{}
+	d.SetEventLog(log)
+	if _, err := d.Run(op); err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	dec := json.NewDecoder(log)
+	for dec.More() {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, e.Type)
+	}
+	return kinds
+}
+
+func TestDockerDriver_SetEventLog_PullSkipped(t *testing.T) {
+	is := assert.New(t)
+	// The image is available locally, so the container is created without pulling it.
+	fc := newRunFakeClient()
+	fc.imagePullFunc = func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+		t.Fatalf("image %s is available locally and should not be pulled", ref)
+		return nil, nil
+	}
+	is.Contains(eventTypes(t, newFakeDockerDriver(fc), testOperation()), EventImagePullSkipped)
+
+	// The image is missing, so it is pulled before the container is created again.
+	fc = newRunFakeClient()
+	create := fc.containerCreateFunc
+	created := false
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		if !created {
+			created = true
+			return container.ContainerCreateCreatedBody{}, notFoundError("No such image: example.com/test:1.2.3")
+		}
+		return create(config, hostConfig)
+	}
+	fc.imagePullFunc = emptyPull
+	is.NotContains(eventTypes(t, newFakeDockerDriver(fc), testOperation()), EventImagePullSkipped)
+
+	// The image is always pulled.
+	fc = newRunFakeClient()
+	fc.imagePullFunc = emptyPull
+	d := newFakeDockerDriver(fc)
+	d.SetConfig(map[string]string{"PULL_ALWAYS": "1"})
+	is.NotContains(eventTypes(t, d, testOperation()), EventImagePullSkipped)
+}
+
+func TestDockerDriver_SetEventLog_Failure(t *testing.T) {
+	is := assert.New(t)
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		return container.ContainerCreateCreatedBody{}, errors.New("no space left on device")
+	}
+	d := newFakeDockerDriver(fc)
+	log := &bytes.Buffer{}
+	d.SetEventLog(log)
+
+	_, err := d.Run(testOperation())
+	is.Error(err)
+
+	lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+	is.Len(lines, 2)
+	var last Event
+	is.NoError(json.Unmarshal([]byte(lines[1]), &last))
+	is.Equal(EventRunFinished, last.Type)
+	is.Equal("cannot create container: no space left on device", last.Error)
+}
+
+// prependRegistry resolves references without a registry host to registry.example.com.
+func prependRegistry(image string) (string, error) {
+	if image == "" {
+		return "", errors.New("empty reference")
+	}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && strings.ContainsAny(parts[0], ".:") {
+		return image, nil
+	}
+	return "registry.example.com/" + image, nil
+}
+
+func TestDockerDriver_SetImageResolver(t *testing.T) {
+	is := assert.New(t)
+	var pulled []string
+	fc := newRunFakeClient()
+	fc.imagePullFunc = func(ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+		pulled = append(pulled, ref)
+		return emptyPull(ref, options)
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetConfig(map[string]string{"PULL_ALWAYS": "1"})
+	d.SetImageResolver(prependRegistry)
+
+	for _, tc := range []struct{ image, resolved string }{
+		{image: "cnab/helloworld:0.1.0", resolved: "registry.example.com/cnab/helloworld:0.1.0"},
+		{image: "example.com/test:1.2.3", resolved: "example.com/test:1.2.3"},
+	} {
+		op := testOperation()
+		op.Image = tc.image
+		cfg, _ := runConfigs(t, d, fc, op)
+		is.Equal(tc.resolved, cfg.Image)
+		is.Equal(tc.image, op.Image, "the operation should not be modified")
+	}
+	is.Equal([]string{"registry.example.com/cnab/helloworld:0.1.0", "example.com/test:1.2.3"}, pulled)
+}
+
+func TestDockerDriver_SetImageResolver_Error(t *testing.T) {
+	fc := newRunFakeClient()
+	fc.containerCreateFunc = func(config *container.Config, hostConfig *container.HostConfig) (container.ContainerCreateCreatedBody, error) {
+		t.Fatal("no container should be created when the image cannot be resolved")
+		return container.ContainerCreateCreatedBody{}, nil
+	}
+	d := newFakeDockerDriver(fc)
+	d.SetImageResolver(prependRegistry)
+	op := testOperation()
+	op.Image = ""
+
+	_, err := d.Run(op)
+	assert.EqualError(t, err, "cannot resolve image : empty reference")
+}
+
+func TestDockerDriver_Run_ImageDigest(t *testing.T) {
+	fc := digestFakeClient("example.com/other@"+otherDigest, "example.com/test@"+testDigest)
+	d := newFakeDockerDriver(fc)
+
+	result, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest, result.ImageDigest)
+}
+
+func TestDockerDriver_Run_ImageDigestOfLocalImage(t *testing.T) {
+	d := newFakeDockerDriver(newRunFakeClient())
+
+	result, err := d.Run(testOperation())
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:4bf92f3577b34da6a3ce929d0e0e4736", result.ImageDigest)
+}
@@ -1,10 +1,16 @@
 package driver
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"os"
+	"strings"
 
 	"github.com/docker/go/canonical/json"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
 )
 
 // ImageType constants provide some of the image types supported
@@ -15,6 +21,9 @@ const (
 	ImageTypeQCOW   = "qcow"
 )
 
+// BundleLabelPrefix prefixes the keys of the labels describing the bundle of an operation
+const BundleLabelPrefix = "io.cnab.bundle."
+
 // Lookup takes a driver name and tries to resolve the most pertinent driver.
 func Lookup(name string) (Driver, error) {
 	switch name {
@@ -44,9 +53,167 @@ type Operation struct {
 	// Environment contains environment variables that should be injected into the invocation image
 	Environment map[string]string `json:"environment"`
 	// Files contains files that should be injected into the invocation image.
+	// /etc/resolv.conf is managed by Docker, its nameservers, search domains and options are
+	// applied to the DNS settings of the container instead.
 	Files map[string]string `json:"files"`
+	// FileModes are the permissions of the files whose mode differs from the default 0644, such as
+	// files holding credentials that only their owner should read.
+	FileModes map[string]os.FileMode `json:"file_modes,omitempty"`
+	// Labels are metadata attached to the container running the invocation image, by drivers supporting it
+	Labels map[string]string `json:"labels,omitempty"`
 	// Output stream for log messages from the driver
 	Out io.Writer
+	// ContainerOut and ContainerErr receive the output of the invocation image for this operation,
+	// overriding the writers configured on the driver, if any.
+	ContainerOut io.Writer `json:"-"`
+	ContainerErr io.Writer `json:"-"`
+	// Context is the context the operation is run in, carrying the trace it is part of, if any.
+	// Drivers supporting it stop the operation once it is done.
+	Context context.Context `json:"-"`
+	// Bundle is the definition of the bundle the operation is part of, if known. Drivers supporting
+	// it use it to describe the operation and validate its outputs.
+	Bundle *bundle.Bundle `json:"-"`
+	// Modifiers describe how the action affects the installation, so that tools running the
+	// operation can decide whether to record it afterwards
+	Modifiers ActionModifiers `json:"modifiers"`
+}
+
+// ActionModifiers describe how an action affects an installation.
+type ActionModifiers struct {
+	// Modifies is true when the action may modify the installation
+	Modifies bool `json:"modifies"`
+	// Stateless is true when the action is purely informational: it requires no credentials and
+	// its invocation should not be tracked
+	Stateless bool `json:"stateless"`
+}
+
+// modifyingActions are the core actions that modify an installation
+var modifyingActions = map[string]bool{"install": true, "upgrade": true, "downgrade": true, "uninstall": true}
+
+// ActionModifiersFor returns the modifiers of an action of a bundle, and whether the action is
+// known. The install, upgrade, downgrade and uninstall actions modify the installation, status does
+// not, and custom actions have the modifiers they are declared with in the bundle.
+//
+// No action is known without a bundle.
+func ActionModifiersFor(b *bundle.Bundle, action string) (ActionModifiers, bool) {
+	if b == nil {
+		return ActionModifiers{}, false
+	}
+	if modifyingActions[action] {
+		return ActionModifiers{Modifies: true}, true
+	}
+	if action == "status" {
+		return ActionModifiers{}, true
+	}
+	def, ok := b.Actions[action]
+	if !ok {
+		return ActionModifiers{}, false
+	}
+	return ActionModifiers{Modifies: def.Modifies, Stateless: def.Stateless}, true
+}
+
+// BundleLabels returns the labels describing a bundle: its name, version, keywords and
+// the names of its maintainers.
+func BundleLabels(b *bundle.Bundle) map[string]string {
+	labels := map[string]string{
+		BundleLabelPrefix + "name":    b.Name,
+		BundleLabelPrefix + "version": b.Version,
+	}
+	if len(b.Keywords) > 0 {
+		labels[BundleLabelPrefix+"keywords"] = strings.Join(b.Keywords, ",")
+	}
+	if len(b.Maintainers) > 0 {
+		names := make([]string, len(b.Maintainers))
+		for i, m := range b.Maintainers {
+			names[i] = m.Name
+		}
+		labels[BundleLabelPrefix+"maintainers"] = strings.Join(names, ",")
+	}
+	return labels
+}
+
+// Hash returns a digest of what determines the outcome of the operation: its action, invocation
+// image, parameters, environment, and files with their modes.
+//
+// The revision, which changes with every run of an installation, is left out, so that two runs
+// of the same operation have the same hash.
+func (op *Operation) Hash() (string, error) {
+	env := make(map[string]string, len(op.Environment))
+	for k, v := range op.Environment {
+		if k != "CNAB_REVISION" {
+			env[k] = v
+		}
+	}
+	data, err := json.MarshalCanonical(struct {
+		Installation string                 `json:"installation_name"`
+		Action       string                 `json:"action"`
+		Image        string                 `json:"image"`
+		ImageType    string                 `json:"image_type"`
+		Parameters   map[string]interface{} `json:"parameters"`
+		Environment  map[string]string      `json:"environment"`
+		Files        map[string]string      `json:"files"`
+		FileModes    map[string]os.FileMode `json:"file_modes,omitempty"`
+	}{op.Installation, op.Action, op.Image, op.ImageType, op.Parameters, env, op.Files, op.FileModes})
+	if err != nil {
+		return "", fmt.Errorf("cannot hash operation: %v", err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data)), nil
+}
+
+// OperationResult is the output of the Driver running an Operation.
+type OperationResult struct {
+	// Changes lists the changes the invocation image made to its file system, for drivers
+	// configured to report them.
+	Changes []FileChange
+	// Outputs contains the content of the outputs written by the invocation image, keyed by
+	// their path in the invocation image.
+	Outputs map[string]string
+	// ExitCode is the exit code of the invocation image, for drivers able to report it.
+	ExitCode int
+	// OutputStatuses tells, for each output found, whether its content could be fetched, so that
+	// outputs missing from Outputs after a partial failure can be told apart.
+	OutputStatuses map[string]OutputStatus
+	// Unchanged is true when the driver did not run the operation, as it is identical to the
+	// last one run.
+	Unchanged bool
+	// RunManifest describes what was run, for drivers configured to report it.
+	RunManifest *RunManifest
+	// Action is the action that produced the outputs, for drivers reporting it, so that the
+	// results of the different actions of an installation can be told apart once persisted.
+	Action string
+	// ImageDigest is the digest of the invocation image that was run, for drivers reporting it,
+	// even when the operation referenced the image by tag. It is the identifier of the image when
+	// the image was not pulled from the repository it is referenced from.
+	ImageDigest string
+}
+
+// Output statuses
+const (
+	OutputFetched = "fetched"
+	OutputFailed  = "failed"
+)
+
+// OutputStatus describes whether an output could be fetched
+type OutputStatus struct {
+	// Status is one of OutputFetched or OutputFailed
+	Status string `json:"status"`
+	// Error is the reason the output could not be fetched
+	Error string `json:"error,omitempty"`
+}
+
+// FileChange kinds
+const (
+	FileAdded   = "added"
+	FileChanged = "changed"
+	FileDeleted = "deleted"
+)
+
+// FileChange describes a change made to a file of the invocation image during an operation
+type FileChange struct {
+	// Kind is one of FileAdded, FileChanged or FileDeleted
+	Kind string `json:"kind"`
+	// Path is the absolute path of the file in the invocation image
+	Path string `json:"path"`
 }
 
 // ResolvedCred is a credential that has been resolved and is ready for injection into the runtime.
@@ -59,7 +226,7 @@ type ResolvedCred struct {
 // Driver is capable of running a invocation image
 type Driver interface {
 	// Run executes the operation inside of the invocation image
-	Run(*Operation) error
+	Run(*Operation) (OperationResult, error)
 	// Handles receives an ImageType* and answers whether this driver supports that type
 	Handles(string) bool
 }
@@ -81,13 +248,13 @@ type DebugDriver struct {
 }
 
 // Run executes the operation on the Debug driver
-func (d *DebugDriver) Run(op *Operation) error {
+func (d *DebugDriver) Run(op *Operation) (OperationResult, error) {
 	data, err := json.MarshalIndent(op, "", "  ")
 	if err != nil {
-		return err
+		return OperationResult{}, err
 	}
 	fmt.Fprintln(op.Out, string(data))
-	return nil
+	return OperationResult{}, nil
 }
 
 // Handles always returns true, effectively claiming to work for any image type
@@ -2,9 +2,12 @@ package driver
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
 )
 
 var _ Driver = &DockerDriver{}
@@ -38,7 +41,8 @@ func TestDebugDriver_Run(t *testing.T) {
 		ImageType:    "oci",
 		Out:          ioutil.Discard,
 	}
-	is.NoError(d.Run(op))
+	_, err = d.Run(op)
+	is.NoError(err)
 }
 
 func TestDockerDriver_Handles(t *testing.T) {
@@ -69,5 +73,81 @@ func TestDockerDriver_Run(t *testing.T) {
 		Files:        map[string]string{},
 		Out:          ioutil.Discard,
 	}
-	is.NoError(d.Run(op))
+	_, err = d.Run(op)
+	is.NoError(err)
+}
+
+func TestOperation_Hash(t *testing.T) {
+	is := assert.New(t)
+	op := func() *Operation {
+		return &Operation{
+			Installation: "test",
+			Revision:     "01D1Y8ZJ9ZTWR6KHTX0NM8SVSD",
+			Action:       "install",
+			Image:        "test:1.2.3",
+			Parameters:   map[string]interface{}{"replicas": 3, "name": "test"},
+			Environment:  map[string]string{"CNAB_REVISION": "01D1Y8ZJ9ZTWR6KHTX0NM8SVSD", "PARAM": "1"},
+			Files:        map[string]string{"/cnab/app/config": "content"},
+		}
+	}
+
+	hash, err := op().Hash()
+	is.NoError(err)
+
+	rerun := op()
+	rerun.Revision = "01D1Y94A7ZS6F3M4RVDS3KCR9B"
+	rerun.Environment["CNAB_REVISION"] = rerun.Revision
+	rerunHash, err := rerun.Hash()
+	is.NoError(err)
+	is.Equal(hash, rerunHash)
+
+	changed := op()
+	changed.Files["/cnab/app/config"] = "new content"
+	changedHash, err := changed.Hash()
+	is.NoError(err)
+	is.NotEqual(hash, changedHash)
+	changedMode := op()
+	changedMode.FileModes = map[string]os.FileMode{"/cnab/app/config": 0600}
+	changedModeHash, err := changedMode.Hash()
+	is.NoError(err)
+	is.NotEqual(hash, changedModeHash)
+}
+
+func TestActionModifiersFor(t *testing.T) {
+	b := &bundle.Bundle{
+		Actions: map[string]bundle.Action{
+			"migrate": {Modifies: true},
+			"logs":    {Stateless: true},
+			"dry-run": {},
+		},
+	}
+	testcases := []struct {
+		action    string
+		modifiers ActionModifiers
+		known     bool
+	}{
+		{action: "install", modifiers: ActionModifiers{Modifies: true}, known: true},
+		{action: "uninstall", modifiers: ActionModifiers{Modifies: true}, known: true},
+		{action: "status", modifiers: ActionModifiers{}, known: true},
+		{action: "migrate", modifiers: ActionModifiers{Modifies: true}, known: true},
+		{action: "logs", modifiers: ActionModifiers{Stateless: true}, known: true},
+		{action: "dry-run", modifiers: ActionModifiers{}, known: true},
+		{action: "undefined", modifiers: ActionModifiers{}, known: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.action, func(t *testing.T) {
+			is := assert.New(t)
+			modifiers, known := ActionModifiersFor(b, tc.action)
+			is.Equal(tc.modifiers, modifiers)
+			is.Equal(tc.known, known)
+		})
+	}
+}
+
+func TestActionModifiersFor_NoBundle(t *testing.T) {
+	is := assert.New(t)
+	modifiers, known := ActionModifiersFor(nil, "install")
+	is.Equal(ActionModifiers{}, modifiers)
+	is.False(known)
 }
@@ -0,0 +1,90 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+// EnvironmentProblem describes why a parameter is not correctly set in an operation's environment
+type EnvironmentProblem struct {
+	// Parameter is the name of the parameter, as declared in the bundle
+	Parameter string
+	// Variable is the environment variable the parameter is expected in
+	Variable string
+	// Reason explains what is wrong with the variable
+	Reason string
+}
+
+// EnvironmentError lists all the problems found when validating an operation's environment
+type EnvironmentError struct {
+	Problems []EnvironmentProblem
+}
+
+func (e *EnvironmentError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		msgs[i] = fmt.Sprintf("parameter %q (%s): %s", p.Parameter, p.Variable, p.Reason)
+	}
+	return fmt.Sprintf("invalid environment: %s", strings.Join(msgs, "; "))
+}
+
+// ValidateEnvironment checks the environment of an operation against the parameters declared by a bundle.
+//
+// It reports required parameters applying to the operation's action that are missing from the environment,
+// and values that cannot be converted to the type declared for their parameter. Parameters that are only
+// injected as files are not checked. The returned error, if any, is an *EnvironmentError.
+func ValidateEnvironment(op *Operation, parameters map[string]bundle.ParameterDefinition) error {
+	var problems []EnvironmentProblem
+	for name, def := range parameters {
+		variable := parameterEnvVar(name, def)
+		if variable == "" {
+			continue
+		}
+		val, ok := op.Environment[variable]
+		if !ok {
+			if def.Required && appliesTo(op.Action, def) {
+				problems = append(problems, EnvironmentProblem{Parameter: name, Variable: variable, Reason: "required parameter is missing"})
+			}
+			continue
+		}
+		if def.DataType == "" {
+			continue
+		}
+		if _, err := def.ConvertValue(val); err != nil {
+			problems = append(problems, EnvironmentProblem{
+				Parameter: name,
+				Variable:  variable,
+				Reason:    fmt.Sprintf("value is not a valid %s: %s", def.DataType, err),
+			})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Parameter < problems[j].Parameter })
+	return &EnvironmentError{Problems: problems}
+}
+
+// parameterEnvVar returns the environment variable a parameter is injected as, or an empty string
+// if the parameter is only injected as a file.
+func parameterEnvVar(name string, def bundle.ParameterDefinition) string {
+	if def.Destination == nil {
+		return fmt.Sprintf("CNAB_P_%s", strings.ToUpper(name))
+	}
+	return def.Destination.EnvironmentVariable
+}
+
+func appliesTo(action string, def bundle.ParameterDefinition) bool {
+	if len(def.ApplyTo) == 0 {
+		return true
+	}
+	for _, act := range def.ApplyTo {
+		if action == act {
+			return true
+		}
+	}
+	return false
+}
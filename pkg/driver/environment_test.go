@@ -0,0 +1,87 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+func testParameters() map[string]bundle.ParameterDefinition {
+	return map[string]bundle.ParameterDefinition{
+		"replicas": {
+			DataType: "int",
+			Required: true,
+		},
+		"debug": {
+			DataType: "bool",
+			Destination: &bundle.Location{
+				EnvironmentVariable: "DEBUG",
+			},
+		},
+		"config": {
+			DataType: "string",
+			Required: true,
+			Destination: &bundle.Location{
+				Path: "/cnab/app/config",
+			},
+		},
+		"backup_target": {
+			DataType: "string",
+			Required: true,
+			ApplyTo:  []string{"backup"},
+		},
+	}
+}
+
+func TestValidateEnvironment(t *testing.T) {
+	op := &Operation{
+		Action: "install",
+		Environment: map[string]string{
+			"CNAB_P_REPLICAS": "3",
+			"DEBUG":           "true",
+		},
+	}
+	assert.NoError(t, ValidateEnvironment(op, testParameters()))
+}
+
+func TestValidateEnvironment_MissingRequired(t *testing.T) {
+	is := assert.New(t)
+	op := &Operation{
+		Action: "backup",
+		Environment: map[string]string{
+			"DEBUG": "false",
+		},
+	}
+	err := ValidateEnvironment(op, testParameters())
+	is.Error(err)
+	envErr, ok := err.(*EnvironmentError)
+	is.True(ok)
+	is.Equal([]EnvironmentProblem{
+		{Parameter: "backup_target", Variable: "CNAB_P_BACKUP_TARGET", Reason: "required parameter is missing"},
+		{Parameter: "replicas", Variable: "CNAB_P_REPLICAS", Reason: "required parameter is missing"},
+	}, envErr.Problems)
+}
+
+func TestValidateEnvironment_WrongType(t *testing.T) {
+	is := assert.New(t)
+	op := &Operation{
+		Action: "install",
+		Environment: map[string]string{
+			"CNAB_P_REPLICAS": "three",
+			"DEBUG":           "maybe",
+		},
+	}
+	err := ValidateEnvironment(op, testParameters())
+	is.Error(err)
+	envErr, ok := err.(*EnvironmentError)
+	is.True(ok)
+	is.Len(envErr.Problems, 2)
+	is.Equal("debug", envErr.Problems[0].Parameter)
+	is.Equal("DEBUG", envErr.Problems[0].Variable)
+	is.Contains(envErr.Problems[0].Reason, "value is not a valid bool")
+	is.Equal("replicas", envErr.Problems[1].Parameter)
+	is.Contains(envErr.Problems[1].Reason, "value is not a valid int")
+	is.Contains(err.Error(), `parameter "replicas" (CNAB_P_REPLICAS): value is not a valid int`)
+}
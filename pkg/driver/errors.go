@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrContainerRuntime is wrapped by the errors returned when the container runtime could not run the
+// invocation image, as opposed to the invocation image itself failing.
+var ErrContainerRuntime = errors.New("the container runtime could not run the invocation image")
+
+// containerRuntimeError is an error of the container runtime, that unwraps to ErrContainerRuntime.
+type containerRuntimeError string
+
+func (e containerRuntimeError) Error() string {
+	return string(e)
+}
+
+func (e containerRuntimeError) Unwrap() error {
+	return ErrContainerRuntime
+}
+
+// ErrUnsafeOutputPath is wrapped by the errors returned for outputs archive entries whose path
+// escapes the outputs directory, such as entries crafted with "../" to overwrite other files.
+var ErrUnsafeOutputPath = errors.New("output path escapes the outputs directory")
+
+// unsafeOutputPathError is returned for an outputs archive entry escaping the outputs directory.
+type unsafeOutputPathError struct {
+	entry string
+}
+
+func (e unsafeOutputPathError) Error() string {
+	return fmt.Sprintf("output %s is outside of %s", e.entry, outputsDir)
+}
+
+func (e unsafeOutputPathError) Unwrap() error {
+	return ErrUnsafeOutputPath
+}
+
+// PullError is returned by PullBundleImages and holds the error of each image that could not be pulled.
+type PullError struct {
+	Errors []error
+}
+
+func (e *PullError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("cannot pull bundle images: %s", strings.Join(msgs, "; "))
+}
+
+// isContainerRuntimeExitCode tells whether an exit code is one of the codes reserved by Docker
+// for failures to run the command of a container:
+//
+//	125: the container could not be run
+//	126: the command could not be invoked
+//	127: the command could not be found
+func isContainerRuntimeExitCode(code int64) bool {
+	return code >= 125 && code <= 127
+}
@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Types of the events written to the event log of a driver
+const (
+	EventRunStarted       = "run_started"
+	EventImagePullSkipped = "image_pull_skipped"
+	EventContainerCreated = "container_created"
+	EventImageResolved    = "image_resolved"
+	EventContainerStarted = "container_started"
+	EventContainerExited  = "container_exited"
+	EventOutputsFetched   = "outputs_fetched"
+	EventRunFinished      = "run_finished"
+)
+
+// Event is an entry of the event log of a run, written as a single line of JSON.
+type Event struct {
+	// Type is one of the Event* constants
+	Type string `json:"type"`
+	// Time is when the event occurred
+	Time time.Time `json:"time"`
+	// ElapsedMs is the time elapsed since the run started, in milliseconds
+	ElapsedMs int64 `json:"elapsedMs"`
+	// Action and Installation identify the operation the run is for
+	Action       string `json:"action"`
+	Installation string `json:"installation"`
+	// Image is the reference of the invocation image, and ImageDigest the digest it resolved to
+	Image       string `json:"image,omitempty"`
+	ImageDigest string `json:"imageDigest,omitempty"`
+	// ContainerID is the identifier of the container running the invocation image
+	ContainerID string `json:"containerId,omitempty"`
+	// ExitCode is the exit code of the invocation image, once it exited
+	ExitCode *int `json:"exitCode,omitempty"`
+	// Outputs are the paths of the outputs fetched, in order
+	Outputs []string `json:"outputs,omitempty"`
+	// Error is the error the run failed with
+	Error string `json:"error,omitempty"`
+}
+
+// eventLog writes the events of a run to a writer. A nil *eventLog discards them.
+type eventLog struct {
+	enc   *json.Encoder
+	op    *Operation
+	start time.Time
+}
+
+// newEventLog returns the event log of a run of op started at start, nil when w is nil.
+func newEventLog(w io.Writer, op *Operation, start time.Time) *eventLog {
+	if w == nil {
+		return nil
+	}
+	return &eventLog{enc: json.NewEncoder(w), op: op, start: start}
+}
+
+// emit writes an event, filling in its time and the operation it is about. The run does not
+// fail when the event cannot be written.
+func (l *eventLog) emit(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.ElapsedMs = int64(e.Time.Sub(l.start) / time.Millisecond)
+	e.Action = l.op.Action
+	e.Installation = l.op.Installation
+	l.enc.Encode(e)
+}
+
+// outputsFetched writes the paths of the outputs of a run.
+func (l *eventLog) outputsFetched(outputs map[string]string) {
+	if l == nil {
+		return
+	}
+	paths := make([]string, 0, len(outputs))
+	for path := range outputs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	l.emit(Event{Type: EventOutputsFetched, Outputs: paths})
+}
+
+// finished writes the end of a run, along with its error, if any.
+func (l *eventLog) finished(err error) {
+	if l == nil {
+		return
+	}
+	e := Event{Type: EventRunFinished}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.emit(e)
+}
@@ -0,0 +1,45 @@
+package driver
+
+import (
+	"fmt"
+	"io/fs"
+	unix_path "path"
+)
+
+// AddFilesFromFS returns the files to inject into the invocation image, as expected by
+// Operation.Files, for the regular files under root in fsys, such as an embed.FS shipping
+// default scripts. Each file is injected in containerDir, at its path relative to root.
+//
+// Directories are walked recursively, other files such as symbolic links are skipped.
+func AddFilesFromFS(fsys fs.FS, root, containerDir string) (map[string]string, error) {
+	if !unix_path.IsAbs(containerDir) {
+		return nil, fmt.Errorf("destination directory %s should be an absolute unix path", containerDir)
+	}
+	files := map[string]string{}
+	err := fs.WalkDir(fsys, root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		// When root is a file, it is injected in containerDir under its own name.
+		rel := unix_path.Base(path)
+		switch {
+		case root == ".":
+			rel = path
+		case path != root:
+			rel = path[len(root)+1:]
+		}
+		files[unix_path.Join(containerDir, rel)] = string(content)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read files from %s: %v", root, err)
+	}
+	return files, nil
+}
@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddFilesFromFS(t *testing.T) {
+	is := assert.New(t)
+	fsys := fstest.MapFS{
+		"assets/run.sh":          {Data: []byte("#!/bin/sh")},
+		"assets/config/app.yaml": {Data: []byte("replicas: 1")},
+		"assets/config/empty":    {Mode: fs.ModeDir},
+		"assets/link":            {Data: []byte("run.sh"), Mode: fs.ModeSymlink},
+		"other/ignored.txt":      {Data: []byte("ignored")},
+	}
+
+	files, err := AddFilesFromFS(fsys, "assets", "/cnab/app")
+	is.NoError(err)
+	is.Equal(map[string]string{
+		"/cnab/app/run.sh":          "#!/bin/sh",
+		"/cnab/app/config/app.yaml": "replicas: 1",
+	}, files)
+}
+
+func TestAddFilesFromFS_Root(t *testing.T) {
+	is := assert.New(t)
+	fsys := fstest.MapFS{
+		"run.sh":          {Data: []byte("#!/bin/sh")},
+		"config/app.yaml": {Data: []byte("replicas: 1")},
+	}
+
+	files, err := AddFilesFromFS(fsys, ".", "/cnab/app")
+	is.NoError(err)
+	is.Equal(map[string]string{
+		"/cnab/app/run.sh":          "#!/bin/sh",
+		"/cnab/app/config/app.yaml": "replicas: 1",
+	}, files)
+
+	files, err = AddFilesFromFS(fsys, "run.sh", "/cnab/app")
+	is.NoError(err)
+	is.Equal(map[string]string{"/cnab/app/run.sh": "#!/bin/sh"}, files)
+}
+
+func TestAddFilesFromFS_Errors(t *testing.T) {
+	is := assert.New(t)
+	fsys := fstest.MapFS{"run.sh": {Data: []byte("#!/bin/sh")}}
+
+	_, err := AddFilesFromFS(fsys, ".", "cnab/app")
+	is.EqualError(err, "destination directory cnab/app should be an absolute unix path")
+	_, err = AddFilesFromFS(fsys, "missing", "/cnab/app")
+	is.Error(err)
+}
@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatedLogFileTimeFormat is the format of the suffix appended to the name of rotated log files
+const rotatedLogFileTimeFormat = "20060102T150405Z"
+
+// logFile is the file the combined output of a container is copied to.
+//
+// The output of a container can still be streamed while the run returns, so once the file is closed,
+// writes are discarded rather than failing, which would interrupt the other writers of the output.
+type logFile struct {
+	mu     sync.Mutex
+	f      *os.File
+	closed bool
+}
+
+// openLogFile creates the log file at path. When the file already exists, it is renamed after its
+// modification time if rotate is true, and an error is returned otherwise.
+func openLogFile(path string, rotate bool) (*logFile, error) {
+	if rotate {
+		info, err := os.Stat(path)
+		switch {
+		case err == nil:
+			rotated := fmt.Sprintf("%s.%s", path, info.ModTime().UTC().Format(rotatedLogFileTimeFormat))
+			if err := os.Rename(path, rotated); err != nil {
+				return nil, fmt.Errorf("cannot rotate log file %s: %v", path, err)
+			}
+		case !os.IsNotExist(err):
+			return nil, fmt.Errorf("cannot rotate log file %s: %v", path, err)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("log file %s already exists", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot create log file: %v", err)
+	}
+	return &logFile{f: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return len(p), nil
+	}
+	return l.f.Write(p)
+}
+
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	return l.f.Close()
+}
@@ -0,0 +1,31 @@
+package driver
+
+import "time"
+
+// Run statuses reported to a MetricsRecorder
+const (
+	RunSucceeded = "success"
+	RunFailed    = "failure"
+)
+
+// MetricsRecorder receives metrics about the operations run by a driver, so that they can be
+// exported to a monitoring system such as Prometheus.
+type MetricsRecorder interface {
+	// IncRunTotal counts a run of the action, with the status RunSucceeded or RunFailed.
+	IncRunTotal(action, status string)
+	// ObserveRunDuration records how long a run of the action took.
+	ObserveRunDuration(action string, duration time.Duration)
+}
+
+// recordRun reports a run that started at start and ended with err to metrics, if any.
+func recordRun(metrics MetricsRecorder, action string, start time.Time, err error) {
+	if metrics == nil {
+		return
+	}
+	status := RunSucceeded
+	if err != nil {
+		status = RunFailed
+	}
+	metrics.ObserveRunDuration(action, time.Since(start))
+	metrics.IncRunTotal(action, status)
+}
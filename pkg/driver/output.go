@@ -0,0 +1,127 @@
+package driver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+// Archive formats supported by ArchiveOutputs
+const (
+	ArchiveTar = "tar"
+	ArchiveZip = "zip"
+)
+
+// outputMode is the mode of the files written by ArchiveOutputs, as the mode of outputs is not
+// part of an OperationResult.
+const outputMode = 0644
+
+// OutputInfo describes an output without its content.
+type OutputInfo struct {
+	// Path is the path of the output in the invocation image
+	Path string
+	// Size is the size of the output, in bytes
+	Size int64
+	// Mode is the file mode of the output
+	Mode os.FileMode
+}
+
+// DecodeOutput decodes the raw content of an output according to its content type.
+//
+// JSON outputs, of type application/json or with a +json suffix, are unmarshaled into an
+// interface{}. Text and outputs of other content types are returned as a string, unchanged.
+func DecodeOutput(contentType string, raw string) (interface{}, error) {
+	if contentType == "" {
+		return raw, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type %q: %s", contentType, err)
+	}
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		var v interface{}
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			return nil, fmt.Errorf("cannot decode output of type %s: %s", mediaType, err)
+		}
+		return v, nil
+	}
+	return raw, nil
+}
+
+// NamedOutputs returns the outputs of the result by the name they are declared with in the
+// definitions of a bundle, rather than by path, along with the names of the declared outputs that
+// were not produced, in order. Outputs that are not declared are left out.
+func (r OperationResult) NamedOutputs(definitions map[string]bundle.OutputDefinition) (map[string]string, []string) {
+	named := make(map[string]string, len(definitions))
+	var missing []string
+	for name, def := range definitions {
+		value, ok := r.Outputs[def.Path]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		named[name] = value
+	}
+	sort.Strings(missing)
+	return named, missing
+}
+
+// ArchiveOutputs writes the outputs of the result to w, as an archive of the given format,
+// ArchiveTar or ArchiveZip.
+//
+// Entries are named after the path of the outputs in the invocation image, without the leading
+// slash, such as cnab/app/outputs/kubeconfig, and are written in order.
+func (r OperationResult) ArchiveOutputs(w io.Writer, format string) error {
+	names := make([]string, 0, len(r.Outputs))
+	for name := range r.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch format {
+	case ArchiveTar:
+		tw := tar.NewWriter(w)
+		for _, name := range names {
+			content := r.Outputs[name]
+			hdr := &tar.Header{
+				Name: strings.TrimPrefix(name, "/"),
+				Mode: outputMode,
+				Size: int64(len(content)),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return fmt.Errorf("cannot archive output %s: %v", name, err)
+			}
+			if _, err := io.WriteString(tw, content); err != nil {
+				return fmt.Errorf("cannot archive output %s: %v", name, err)
+			}
+		}
+		return tw.Close()
+	case ArchiveZip:
+		zw := zip.NewWriter(w)
+		for _, name := range names {
+			hdr := &zip.FileHeader{
+				Name:   strings.TrimPrefix(name, "/"),
+				Method: zip.Deflate,
+			}
+			hdr.SetMode(outputMode)
+			f, err := zw.CreateHeader(hdr)
+			if err != nil {
+				return fmt.Errorf("cannot archive output %s: %v", name, err)
+			}
+			if _, err := io.WriteString(f, r.Outputs[name]); err != nil {
+				return fmt.Errorf("cannot archive output %s: %v", name, err)
+			}
+		}
+		return zw.Close()
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+}
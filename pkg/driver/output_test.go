@@ -0,0 +1,153 @@
+package driver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+func TestDecodeOutput_JSON(t *testing.T) {
+	is := assert.New(t)
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "application/vnd.cnab+json"} {
+		v, err := DecodeOutput(contentType, `{"replicas": 3, "hosts": ["a", "b"]}`)
+		is.NoError(err)
+		is.Equal(map[string]interface{}{
+			"replicas": float64(3),
+			"hosts":    []interface{}{"a", "b"},
+		}, v)
+	}
+
+	_, err := DecodeOutput("application/json", "{")
+	is.EqualError(err, "cannot decode output of type application/json: unexpected end of JSON input")
+}
+
+func TestDecodeOutput_Text(t *testing.T) {
+	v, err := DecodeOutput("text/plain; charset=utf-8", "hello\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", v)
+}
+
+func TestDecodeOutput_Unknown(t *testing.T) {
+	is := assert.New(t)
+	for _, contentType := range []string{"", "application/octet-stream", "application/x-yaml"} {
+		v, err := DecodeOutput(contentType, "key: {value")
+		is.NoError(err)
+		is.Equal("key: {value", v)
+	}
+
+	_, err := DecodeOutput("not a/content type", "")
+	is.Error(err)
+}
+
+func testResult() OperationResult {
+	return OperationResult{
+		Outputs: map[string]string{
+			"/cnab/app/outputs/kubeconfig":   "apiVersion: v1",
+			"/cnab/app/outputs/nested/ip":    "10.0.0.1",
+			"/cnab/app/outputs/empty-output": "",
+		},
+	}
+}
+
+func TestArchiveOutputs_Tar(t *testing.T) {
+	is := assert.New(t)
+	var buf bytes.Buffer
+	is.NoError(testResult().ArchiveOutputs(&buf, ArchiveTar))
+
+	outputs := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		is.NoError(err)
+		is.Equal(int64(0644), hdr.Mode)
+		content, err := ioutil.ReadAll(tr)
+		is.NoError(err)
+		outputs["/"+hdr.Name] = string(content)
+	}
+	is.Equal(testResult().Outputs, outputs)
+}
+
+func TestArchiveOutputs_Zip(t *testing.T) {
+	is := assert.New(t)
+	var buf bytes.Buffer
+	is.NoError(testResult().ArchiveOutputs(&buf, ArchiveZip))
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	is.NoError(err)
+	outputs := map[string]string{}
+	for _, f := range zr.File {
+		is.Equal(os.FileMode(0644), f.Mode())
+		rc, err := f.Open()
+		is.NoError(err)
+		content, err := ioutil.ReadAll(rc)
+		is.NoError(err)
+		rc.Close()
+		outputs["/"+f.Name] = string(content)
+	}
+	is.Equal(testResult().Outputs, outputs)
+}
+
+func TestArchiveOutputs_UnsupportedFormat(t *testing.T) {
+	err := testResult().ArchiveOutputs(ioutil.Discard, "rar")
+	assert.EqualError(t, err, `unsupported archive format "rar"`)
+}
+
+func TestOperationResult_NamedOutputs(t *testing.T) {
+	definitions := map[string]bundle.OutputDefinition{
+		"kubeconfig": {Path: "/cnab/app/outputs/kubeconfig"},
+		"token":      {Path: "/cnab/app/outputs/token"},
+		"report":     {Path: "/cnab/app/outputs/report.json"},
+	}
+	testcases := []struct {
+		name    string
+		outputs map[string]string
+		named   map[string]string
+		missing []string
+	}{
+		{
+			name: "full",
+			outputs: map[string]string{
+				"/cnab/app/outputs/kubeconfig":  "config",
+				"/cnab/app/outputs/token":       "secret",
+				"/cnab/app/outputs/report.json": "{}",
+			},
+			named: map[string]string{"kubeconfig": "config", "token": "secret", "report": "{}"},
+		},
+		{
+			name:    "partial",
+			outputs: map[string]string{"/cnab/app/outputs/token": "secret"},
+			named:   map[string]string{"token": "secret"},
+			missing: []string{"kubeconfig", "report"},
+		},
+		{
+			name: "extra",
+			outputs: map[string]string{
+				"/cnab/app/outputs/kubeconfig":  "config",
+				"/cnab/app/outputs/token":       "secret",
+				"/cnab/app/outputs/report.json": "{}",
+				"/cnab/app/outputs/debug.log":   "log",
+			},
+			named: map[string]string{"kubeconfig": "config", "token": "secret", "report": "{}"},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			is := assert.New(t)
+			named, missing := OperationResult{Outputs: tc.outputs}.NamedOutputs(definitions)
+			is.Equal(tc.named, named)
+			is.Equal(tc.missing, missing)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package driver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// resolvConfPath is the path of the DNS resolver configuration. Docker manages that file, so when
+// an operation injects it, its content is applied to the DNS settings of the container instead.
+const resolvConfPath = "/etc/resolv.conf"
+
+// resolvConf holds the settings of a resolv.conf file that Docker can apply to a container
+type resolvConf struct {
+	nameservers []string
+	search      []string
+	options     []string
+}
+
+// parseResolvConf parses the content of a resolv.conf file, as described in resolv.conf(5).
+//
+// As with the resolver, the last of the domain and search lines wins, and other keywords,
+// such as sortlist, are ignored.
+func parseResolvConf(content string) (resolvConf, error) {
+	var conf resolvConf
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) != 2 || net.ParseIP(fields[1]) == nil {
+				return resolvConf{}, fmt.Errorf("line %d: nameserver should be followed by an IP address", line)
+			}
+			conf.nameservers = append(conf.nameservers, fields[1])
+		case "domain", "search":
+			if len(fields) < 2 {
+				return resolvConf{}, fmt.Errorf("line %d: %s should be followed by a domain", line, fields[0])
+			}
+			conf.search = fields[1:]
+		case "options":
+			conf.options = append(conf.options, fields[1:]...)
+		}
+	}
+	return conf, scanner.Err()
+}
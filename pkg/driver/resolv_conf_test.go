@@ -0,0 +1,41 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseResolvConf(t *testing.T) {
+	is := assert.New(t)
+	conf, err := parseResolvConf(`# Generated for the restricted network
+nameserver 10.0.0.2
+nameserver fd00::2
+; the search list is replaced by the last domain or search line
+domain corp.example.com
+search svc.cluster.local cluster.local
+options ndots:5 timeout:2
+options rotate
+sortlist 10.0.0.0/255.0.0.0
+`)
+	is.NoError(err)
+	is.Equal([]string{"10.0.0.2", "fd00::2"}, conf.nameservers)
+	is.Equal([]string{"svc.cluster.local", "cluster.local"}, conf.search)
+	is.Equal([]string{"ndots:5", "timeout:2", "rotate"}, conf.options)
+}
+
+func TestParseResolvConf_Empty(t *testing.T) {
+	conf, err := parseResolvConf("\n# nothing to see\n")
+	assert.NoError(t, err)
+	assert.Equal(t, resolvConf{}, conf)
+}
+
+func TestParseResolvConf_Errors(t *testing.T) {
+	is := assert.New(t)
+	_, err := parseResolvConf("nameserver 10.0.0.2\nnameserver dns.example.com\n")
+	is.EqualError(err, "line 2: nameserver should be followed by an IP address")
+	_, err = parseResolvConf("nameserver\n")
+	is.EqualError(err, "line 1: nameserver should be followed by an IP address")
+	_, err = parseResolvConf("search\n")
+	is.EqualError(err, "line 1: search should be followed by a domain")
+}
@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+)
+
+// retryPolicy bounds how many times, and how often, an operation failing with transient errors is attempted
+type retryPolicy struct {
+	// attempts is the maximum number of attempts, including the first one
+	attempts int
+	// backoff is the delay before the first retry, it doubles after each attempt
+	backoff time.Duration
+}
+
+// do calls fn until it succeeds, fails with an error for which transient returns false,
+// or the attempts are exhausted. The last error is returned.
+//
+// Waiting for the next attempt stops as soon as ctx is done, the error of ctx is then returned.
+func (p retryPolicy) do(ctx context.Context, fn func() error, transient func(error) bool) error {
+	backoff := p.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || attempt >= p.attempts || !transient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// transientDaemonErrors are fragments of error messages returned by a daemon under load
+var transientDaemonErrors = []string{
+	"device or resource busy",
+	"resource temporarily unavailable",
+	"too many open files",
+}
+
+// isTransientDaemonError tells whether an error returned by the daemon is worth retrying.
+func isTransientDaemonError(err error) bool {
+	if client.IsErrNotFound(err) {
+		return false
+	}
+	if client.IsErrConnectionFailed(err) {
+		return true
+	}
+	msg := err.Error()
+	for _, fragment := range transientDaemonErrors {
+		if strings.Contains(msg, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientCreateError tells whether an error returned by the daemon when creating a container is
+// worth retrying. Unlike starting a container, creating one is not idempotent: when the connection
+// fails, the daemon may already have created the container, and creating another would leak it.
+func isTransientCreateError(err error) bool {
+	return !client.IsErrConnectionFailed(err) && isTransientDaemonError(err)
+}
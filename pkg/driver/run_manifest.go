@@ -0,0 +1,109 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// RunManifest describes exactly what a driver executed for an operation, for reproducibility and
+// auditing. It holds no secret: the values of environment variables and the content of files
+// are left out.
+type RunManifest struct {
+	// Image is the reference of the invocation image
+	Image string `json:"image"`
+	// ImageID is the identifier of the image that was run, the digest of its configuration
+	ImageID string `json:"imageId,omitempty"`
+	// RepoDigests are the digests of the manifests of the image in its repositories
+	RepoDigests []string `json:"repoDigests,omitempty"`
+	// Entrypoint and Cmd are the command run in the container
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Cmd        []string `json:"cmd,omitempty"`
+	// WorkingDir is the working directory of the command
+	WorkingDir string `json:"workingDir,omitempty"`
+	// EnvKeys are the names of the environment variables of the container, in order
+	EnvKeys []string `json:"envKeys,omitempty"`
+	// Files describes the files injected into the container, by path
+	Files map[string]RunManifestFile `json:"files,omitempty"`
+	// Host summarizes the configuration of the container on its host
+	Host RunManifestHost `json:"host"`
+}
+
+// RunManifestFile describes a file injected into a container.
+type RunManifestFile struct {
+	// SHA256 is the digest of the content of the file, as sha256:<hex>. It is redacted for files
+	// that only their owner can read, such as credentials, as the digest of a short secret is
+	// enough to guess it.
+	SHA256 string `json:"sha256"`
+	// Mode is the mode of the file
+	Mode os.FileMode `json:"mode"`
+}
+
+// redactedDigest replaces the digest of the files that only their owner can read.
+const redactedDigest = "redacted"
+
+// RunManifestHost summarizes the host configuration of a container.
+type RunManifestHost struct {
+	Privileged  bool     `json:"privileged,omitempty"`
+	Init        bool     `json:"init,omitempty"`
+	PidMode     string   `json:"pidMode,omitempty"`
+	Runtime     string   `json:"runtime,omitempty"`
+	Memory      int64    `json:"memory,omitempty"`
+	ShmSize     int64    `json:"shmSize,omitempty"`
+	SecurityOpt []string `json:"securityOpt,omitempty"`
+	// Mounts are the mounts of the container, as source:target[:ro]
+	Mounts []string `json:"mounts,omitempty"`
+}
+
+// newRunManifest describes the container created to run an image, inspected as ii, with the given
+// files, whose mode is 0644 unless set in modes.
+func newRunManifest(ii types.ImageInspect, cfg *container.Config, hostCfg *container.HostConfig, files map[string]string, modes map[string]os.FileMode) *RunManifest {
+	m := &RunManifest{
+		Image:       cfg.Image,
+		ImageID:     ii.ID,
+		RepoDigests: ii.RepoDigests,
+		Entrypoint:  cfg.Entrypoint,
+		Cmd:         cfg.Cmd,
+		WorkingDir:  cfg.WorkingDir,
+		Host: RunManifestHost{
+			Privileged:  hostCfg.Privileged,
+			Init:        hostCfg.Init != nil && *hostCfg.Init,
+			PidMode:     string(hostCfg.PidMode),
+			Runtime:     hostCfg.Runtime,
+			Memory:      hostCfg.Memory,
+			ShmSize:     hostCfg.ShmSize,
+			SecurityOpt: hostCfg.SecurityOpt,
+		},
+	}
+	for _, env := range cfg.Env {
+		m.EnvKeys = append(m.EnvKeys, strings.SplitN(env, "=", 2)[0])
+	}
+	sort.Strings(m.EnvKeys)
+	for path, content := range files {
+		mode, ok := modes[path]
+		if !ok {
+			mode = 0644
+		}
+		f := RunManifestFile{SHA256: redactedDigest, Mode: mode}
+		if mode.Perm()&0044 != 0 {
+			f.SHA256 = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		}
+		if m.Files == nil {
+			m.Files = make(map[string]RunManifestFile, len(files))
+		}
+		m.Files[path] = f
+	}
+	for _, mnt := range hostCfg.Mounts {
+		desc := mnt.Source + ":" + mnt.Target
+		if mnt.ReadOnly {
+			desc += ":ro"
+		}
+		m.Host.Mounts = append(m.Host.Mounts, desc)
+	}
+	return m
+}
@@ -0,0 +1,54 @@
+package driver
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// StatsSample is a measure of the resources used by a container running an invocation image.
+type StatsSample struct {
+	// Time is when the sample was taken
+	Time time.Time
+	// CPUPercent is the CPU usage of the container since the previous sample, 100 meaning
+	// one full CPU
+	CPUPercent float64
+	// MemoryUsage is the memory used by the container, in bytes
+	MemoryUsage uint64
+	// MemoryLimit is the memory the container can use, in bytes
+	MemoryLimit uint64
+}
+
+// streamStats decodes a stream of container stats, as returned by ContainerStats, passing each
+// sample to handler until the stream ends.
+func streamStats(r io.Reader, handler func(StatsSample)) {
+	dec := json.NewDecoder(r)
+	for {
+		var stats types.StatsJSON
+		if err := dec.Decode(&stats); err != nil {
+			return
+		}
+		handler(newStatsSample(stats))
+	}
+}
+
+func newStatsSample(stats types.StatsJSON) StatsSample {
+	sample := StatsSample{
+		Time:        stats.Read,
+		MemoryUsage: stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}
+	// This is how the CPU usage is computed by docker stats.
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		sample.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+	return sample
+}
@@ -36,10 +36,11 @@ CMD ["/cnab/app/run"]
 func Scaffold(path string) error {
 	name := filepath.Base(path)
 	m := &Manifest{
-		Name:        name,
-		Version:     "0.1.0",
-		Description: "A short description of your bundle",
-		Keywords:    []string{name, "cnab", "tutorial"},
+		SchemaVersion: DefaultSchemaVersion,
+		Name:          name,
+		Version:       "0.1.0",
+		Description:   "A short description of your bundle",
+		Keywords:      []string{name, "cnab", "tutorial"},
 		Maintainers: []bundle.Maintainer{
 			{
 				Name:  "John Doe",
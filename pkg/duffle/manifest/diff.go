@@ -0,0 +1,148 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Change kinds
+const (
+	FieldAdded   = "added"
+	FieldRemoved = "removed"
+	FieldChanged = "changed"
+)
+
+// Change describes a difference between two manifests.
+type Change struct {
+	// Path is the path of the field, such as invocationImages[cnab].builder or keywords[1]
+	Path string
+	// Kind is one of FieldAdded, FieldRemoved or FieldChanged
+	Kind string
+	// Old is the value of the field in the first manifest, nil when it was added
+	Old interface{}
+	// New is the value of the field in the second manifest, nil when it was removed
+	New interface{}
+}
+
+func (c Change) String() string {
+	switch c.Kind {
+	case FieldAdded:
+		return fmt.Sprintf("+ %s: %v", c.Path, c.New)
+	case FieldRemoved:
+		return fmt.Sprintf("- %s: %v", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("~ %s: %v -> %v", c.Path, c.Old, c.New)
+	}
+}
+
+// Diff reports the fields added, removed or changed from manifest a to manifest b.
+//
+// Maps and slices are compared entry by entry, so that only the entries that differ are reported.
+// The directory manifests were loaded from is not taken into account.
+func Diff(a, b *Manifest) ([]Change, error) {
+	if a == nil || b == nil {
+		return nil, errors.New("cannot diff a nil manifest")
+	}
+	var changes []Change
+	diffValues("", reflect.ValueOf(*a), reflect.ValueOf(*b), &changes)
+	return changes, nil
+}
+
+func diffValues(path string, a, b reflect.Value, changes *[]Change) {
+	a, b = indirect(a), indirect(b)
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return
+	case !a.IsValid():
+		*changes = append(*changes, Change{Path: path, Kind: FieldAdded, New: b.Interface()})
+		return
+	case !b.IsValid():
+		*changes = append(*changes, Change{Path: path, Kind: FieldRemoved, Old: a.Interface()})
+		return
+	case a.Type() != b.Type():
+		*changes = append(*changes, Change{Path: path, Kind: FieldChanged, Old: a.Interface(), New: b.Interface()})
+		return
+	}
+
+	switch a.Kind() {
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			field := a.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if field.Anonymous {
+				diffValues(path, a.Field(i), b.Field(i), changes)
+				continue
+			}
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValues(name, a.Field(i), b.Field(i), changes)
+		}
+	case reflect.Map:
+		for _, key := range mapKeys(a, b) {
+			diffValues(fmt.Sprintf("%s[%v]", path, key), a.MapIndex(key), b.MapIndex(key), changes)
+		}
+	case reflect.Slice, reflect.Array:
+		n := a.Len()
+		if b.Len() > n {
+			n = b.Len()
+		}
+		for i := 0; i < n; i++ {
+			var av, bv reflect.Value
+			if i < a.Len() {
+				av = a.Index(i)
+			}
+			if i < b.Len() {
+				bv = b.Index(i)
+			}
+			diffValues(fmt.Sprintf("%s[%d]", path, i), av, bv, changes)
+		}
+	default:
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changes = append(*changes, Change{Path: path, Kind: FieldChanged, Old: a.Interface(), New: b.Interface()})
+		}
+	}
+}
+
+// indirect returns the value pointed to by pointers and interfaces, and an invalid value for nil ones.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// mapKeys returns the keys of both maps, sorted.
+func mapKeys(a, b reflect.Value) []reflect.Value {
+	seen := map[string]reflect.Value{}
+	for _, m := range []reflect.Value{a, b} {
+		for _, key := range m.MapKeys() {
+			seen[fmt.Sprint(key.Interface())] = key
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]reflect.Value, len(names))
+	for i, name := range names {
+		keys[i] = seen[name]
+	}
+	return keys
+}
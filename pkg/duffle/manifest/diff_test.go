@@ -0,0 +1,76 @@
+package manifest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+func TestDiff_Identical(t *testing.T) {
+	is := assert.New(t)
+	a, err := Load("duffle.json", "testdata")
+	is.NoError(err)
+	b, err := Load("duffle.yaml", "testdata")
+	is.NoError(err)
+
+	changes, err := Diff(a, b)
+	is.NoError(err)
+	is.Empty(changes)
+}
+
+func TestDiff_ScalarChanges(t *testing.T) {
+	a, b := validManifest(), validManifest()
+	b.Version = "0.2.0"
+	b.InvocationImages["cnab"].Builder = "buildkit"
+	b.Parameters["foo"] = bundle.ParameterDefinition{DataType: "string", DefaultValue: "baz"}
+
+	changes, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Path: "version", Kind: FieldChanged, Old: "0.1.0", New: "0.2.0"},
+		{Path: "invocationImages[cnab].builder", Kind: FieldChanged, Old: "docker", New: "buildkit"},
+		{Path: "parameters[foo].defaultValue", Kind: FieldChanged, Old: "bar", New: "baz"},
+	}, changes)
+}
+
+func TestDiff_AddedKeys(t *testing.T) {
+	a, b := validManifest(), validManifest()
+	b.Keywords = []string{"cnab"}
+	b.Credentials["token"] = bundle.Location{EnvironmentVariable: "TOKEN"}
+	b.Images["istio"] = bundle.Image{
+		BaseImage:   bundle.BaseImage{ImageType: "docker", Image: "docker.io/istio/citadel:1.0.2", Digest: "sha256:ca40"},
+		Description: "istio",
+	}
+
+	changes, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Path: "keywords[0]", Kind: FieldAdded, New: "cnab"},
+		{Path: "images[istio].digest", Kind: FieldChanged, Old: "", New: "sha256:ca40"},
+		{Path: "images[istio].description", Kind: FieldChanged, Old: "", New: "istio"},
+		{Path: "credentials[token]", Kind: FieldAdded, New: bundle.Location{EnvironmentVariable: "TOKEN"}},
+	}, changes)
+}
+
+func TestDiff_RemovedKeys(t *testing.T) {
+	a, b := validManifest(), validManifest()
+	a.Maintainers = []bundle.Maintainer{{Name: "sally"}, {Name: "bob"}}
+	b.Maintainers = []bundle.Maintainer{{Name: "sally"}}
+	delete(b.InvocationImages, "cnab")
+	b.Parameters["foo"] = bundle.ParameterDefinition{DataType: "string"}
+
+	changes, err := Diff(a, b)
+	assert.NoError(t, err)
+	assert.Equal(t, []Change{
+		{Path: "maintainers[1]", Kind: FieldRemoved, Old: bundle.Maintainer{Name: "bob"}},
+		{Path: "invocationImages[cnab]", Kind: FieldRemoved, Old: InvocationImage{Name: "cnab", Builder: "docker"}},
+		{Path: "parameters[foo].defaultValue", Kind: FieldRemoved, Old: "bar"},
+	}, changes)
+}
+
+func TestDiff_Nil(t *testing.T) {
+	_, err := Diff(nil, validManifest())
+	assert.EqualError(t, err, "cannot diff a nil manifest")
+}
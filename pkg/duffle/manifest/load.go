@@ -10,6 +10,12 @@ import (
 )
 
 // Load opens the named file for reading. If successful, the manifest is returned.
+//
+// Manifests that do not declare a schema version are assumed to use DefaultSchemaVersion, and
+// manifests declaring a version that is not supported are rejected.
+//
+// The SourceDir of the returned manifest is set to the absolute path of the directory
+// containing the file, against which relative file references are resolved.
 func Load(name, dir string) (*Manifest, error) {
 	v := viper.New()
 	if name == "" {
@@ -28,5 +34,15 @@ func Load(name, dir string) (*Manifest, error) {
 	if err != nil {
 		return nil, err
 	}
+	if m.SchemaVersion == "" {
+		m.SchemaVersion = DefaultSchemaVersion
+	}
+	if !SupportedSchemaVersions[m.SchemaVersion] {
+		return nil, fmt.Errorf("unsupported schema version %q in duffle config file", m.SchemaVersion)
+	}
+	m.SourceDir, err = filepath.Abs(filepath.Dir(v.ConfigFileUsed()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine the directory of the duffle config file: %s", err)
+	}
 	return m, nil
 }
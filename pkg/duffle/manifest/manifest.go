@@ -1,16 +1,27 @@
 package manifest
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/radu-matei/cnab-go/pkg/bundle"
 
 	"github.com/technosophos/moniker"
 )
 
+// DefaultSchemaVersion is the schema version of manifests that do not declare one.
+const DefaultSchemaVersion = "v1"
+
+// SupportedSchemaVersions lists the manifest schema versions that can be loaded.
+var SupportedSchemaVersions = map[string]bool{
+	"v1": true,
+}
+
 // Manifest represents a duffle manifest.
 type Manifest struct {
+	SchemaVersion    string                                `json:"schemaVersion,omitempty" mapstructure:"schemaVersion"`
 	Name             string                                `json:"name" mapstructure:"name"`
 	Version          string                                `json:"version" mapstructure:"version"`
 	Description      string                                `json:"description,omitempty" mapstructure:"description"`
@@ -21,6 +32,8 @@ type Manifest struct {
 	Actions          map[string]bundle.Action              `json:"actions,omitempty" mapstructure:"actions"`
 	Parameters       map[string]bundle.ParameterDefinition `json:"parameters,omitempty" mapstructure:"parameters"`
 	Credentials      map[string]bundle.Location            `json:"credentials,omitempty" mapstructure:"credentials"`
+	// SourceDir is the absolute path of the directory the manifest was loaded from.
+	SourceDir string `json:"-" mapstructure:"-"`
 }
 
 // InvocationImage represents an invocation image component of a CNAB bundle
@@ -37,6 +50,38 @@ func New() *Manifest {
 	}
 }
 
+// ResolvePath resolves a file referenced by the manifest against the directory the manifest was
+// loaded from. Absolute paths are returned unchanged.
+func (m *Manifest) ResolvePath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(m.SourceDir, path)
+}
+
+// DefaultEnvironment returns the environment variables holding the default values of the
+// parameters of the manifest, as an invocation image expects them: in the variable of their
+// destination, or in CNAB_P_<NAME> for parameters without a destination. Callers then override
+// them with the values supplied by users.
+//
+// Parameters without a default value, and parameters only injected as files, are left out.
+func (m *Manifest) DefaultEnvironment() map[string]string {
+	env := map[string]string{}
+	for name, def := range m.Parameters {
+		if def.DefaultValue == nil {
+			continue
+		}
+		value := fmt.Sprintf("%v", def.DefaultValue)
+		switch {
+		case def.Destination == nil:
+			env["CNAB_P_"+strings.ToUpper(name)] = value
+		case def.Destination.EnvironmentVariable != "":
+			env[def.Destination.EnvironmentVariable] = value
+		}
+	}
+	return env
+}
+
 // generateName generates a name based on the current working directory or a random name.
 func generateName() string {
 	var name string
@@ -1,10 +1,14 @@
 package manifest
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
 )
 
 func TestNew(t *testing.T) {
@@ -101,6 +105,21 @@ func TestLoad(t *testing.T) {
 	}
 }
 
+func TestLoad_SchemaVersion(t *testing.T) {
+	is := assert.New(t)
+
+	m, err := Load("schema_v1.yaml", "testdata")
+	is.NoError(err)
+	is.Equal("v1", m.SchemaVersion)
+
+	m, err = Load("duffle.json", "testdata")
+	is.NoError(err)
+	is.Equal(DefaultSchemaVersion, m.SchemaVersion)
+
+	_, err = Load("schema_v99.yaml", "testdata")
+	is.EqualError(err, `unsupported schema version "v99" in duffle config file`)
+}
+
 func TestInvalidLoad(t *testing.T) {
 	testcases := []string{"invalid_duffle.json"}
 
@@ -117,6 +136,41 @@ func TestInvalidLoad(t *testing.T) {
 	}
 }
 
+func TestLoad_ResolvePath(t *testing.T) {
+	is := assert.New(t)
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	testdata := filepath.Join(cwd, "testdata")
+
+	testcases := []struct {
+		wd  string
+		dir string
+	}{
+		{wd: cwd, dir: "testdata"},
+		{wd: testdata, dir: "."},
+		{wd: filepath.Dir(cwd), dir: filepath.Join("manifest", "testdata")},
+		{wd: os.TempDir(), dir: testdata},
+	}
+	for _, tc := range testcases {
+		if err := os.Chdir(tc.wd); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"", "duffle.json"} {
+			m, err := Load(name, tc.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			is.Equal(testdata, m.SourceDir)
+			is.Equal(filepath.Join(testdata, "scripts", "setup.sh"), m.ResolvePath("scripts/setup.sh"))
+			is.Equal(filepath.Join(cwd, "params.toml"), m.ResolvePath("../params.toml"))
+			is.Equal("/etc/params.toml", m.ResolvePath("/etc/params.toml"))
+		}
+	}
+}
+
 // the examples directory is no longer part of this repo.
 
 // func TestExamples(t *testing.T) {
@@ -131,3 +185,33 @@ func TestInvalidLoad(t *testing.T) {
 // 		})
 // 	}
 // }
+
+func TestManifest_DefaultEnvironment(t *testing.T) {
+	m := &Manifest{
+		Parameters: map[string]bundle.ParameterDefinition{
+			"replicas": {DataType: "int", DefaultValue: 3},
+			"debug":    {DataType: "bool", DefaultValue: false},
+			"region": {
+				DataType:     "string",
+				DefaultValue: "eu-west-1",
+				Destination:  &bundle.Location{EnvironmentVariable: "AWS_REGION"},
+			},
+			"config": {
+				DataType:     "string",
+				DefaultValue: "{}",
+				Destination:  &bundle.Location{Path: "/cnab/app/config.json"},
+			},
+			"password": {DataType: "string"},
+		},
+	}
+
+	assert.Equal(t, map[string]string{
+		"CNAB_P_REPLICAS": "3",
+		"CNAB_P_DEBUG":    "false",
+		"AWS_REGION":      "eu-west-1",
+	}, m.DefaultEnvironment())
+}
+
+func TestManifest_DefaultEnvironment_NoParameters(t *testing.T) {
+	assert.Empty(t, (&Manifest{}).DefaultEnvironment())
+}
@@ -0,0 +1,121 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+// FieldError describes a problem with a single field of a manifest.
+type FieldError struct {
+	// Field is the path of the offending field, such as invocationImages[cnab].builder
+	Field string
+	// Message describes what is wrong with the field
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError is returned by Validate and holds every problem found in a manifest.
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Error()
+	}
+	return fmt.Sprintf("invalid manifest: %s", strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the first field error, so that errors.As can extract a *FieldError.
+func (e *ValidationError) Unwrap() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e.Errors[0]
+}
+
+// Validate checks the manifest for missing or invalid fields.
+//
+// All the problems found are returned at once in a *ValidationError.
+func (m *Manifest) Validate() error {
+	v := &ValidationError{}
+	if m.Name == "" {
+		v.add("name", "is required")
+	}
+	if m.Version == "latest" {
+		v.add("version", "'latest' is not a valid bundle version")
+	}
+
+	if len(m.InvocationImages) == 0 {
+		v.add("invocationImages", "at least one invocation image must be defined")
+	}
+	for _, name := range invocationImageNames(m.InvocationImages) {
+		img := m.InvocationImages[name]
+		field := fmt.Sprintf("invocationImages[%s]", name)
+		if img == nil {
+			v.add(field, "must not be empty")
+			continue
+		}
+		if img.Name == "" {
+			v.add(field+".name", "is required")
+		}
+		if img.Builder == "" {
+			v.add(field+".builder", "is required")
+		}
+	}
+
+	for _, name := range bundle.ImageNames(m.Images) {
+		if m.Images[name].Image == "" {
+			v.add(fmt.Sprintf("images[%s].image", name), "is required")
+		}
+	}
+
+	for _, name := range bundle.ParameterNames(m.Parameters) {
+		def := m.Parameters[name]
+		field := fmt.Sprintf("parameters[%s]", name)
+		switch def.DataType {
+		case "string", "int", "bool":
+		default:
+			v.add(field+".type", fmt.Sprintf("unsupported type %q", def.DataType))
+			continue
+		}
+		if def.DefaultValue != nil {
+			if err := def.ValidateParameterValue(def.DefaultValue); err != nil {
+				v.add(field+".defaultValue", err.Error())
+			}
+		}
+	}
+
+	for _, name := range bundle.CredentialNames(m.Credentials) {
+		loc := m.Credentials[name]
+		if loc.Path == "" && loc.EnvironmentVariable == "" {
+			v.add(fmt.Sprintf("credentials[%s]", name), "either path or env is required")
+		}
+	}
+
+	if len(v.Errors) > 0 {
+		return v
+	}
+	return nil
+}
+
+func (v *ValidationError) add(field, message string) {
+	v.Errors = append(v.Errors, &FieldError{Field: field, Message: message})
+}
+
+// invocationImageNames returns the names of invocation images in order.
+func invocationImageNames(images map[string]*InvocationImage) []string {
+	names := make([]string, 0, len(images))
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,110 @@
+package manifest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/radu-matei/cnab-go/pkg/bundle"
+)
+
+func validManifest() *Manifest {
+	return &Manifest{
+		Name:    "testbundle",
+		Version: "0.1.0",
+		InvocationImages: map[string]*InvocationImage{
+			"cnab": {Name: "cnab", Builder: "docker"},
+		},
+		Images: map[string]bundle.Image{
+			"istio": {BaseImage: bundle.BaseImage{ImageType: "docker", Image: "docker.io/istio/citadel:1.0.2"}},
+		},
+		Parameters: map[string]bundle.ParameterDefinition{
+			"foo": {DataType: "string", DefaultValue: "bar"},
+		},
+		Credentials: map[string]bundle.Location{
+			"kubeconfig": {Path: "/root/.kube/config"},
+		},
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert.NoError(t, validManifest().Validate())
+}
+
+func TestValidate_FieldPaths(t *testing.T) {
+	testcases := []struct {
+		name   string
+		modify func(*Manifest)
+		fields []string
+	}{
+		{
+			name: "missing name and latest version",
+			modify: func(m *Manifest) {
+				m.Name = ""
+				m.Version = "latest"
+			},
+			fields: []string{"name", "version"},
+		},
+		{
+			name: "no invocation images",
+			modify: func(m *Manifest) {
+				m.InvocationImages = nil
+			},
+			fields: []string{"invocationImages"},
+		},
+		{
+			name: "invalid invocation images",
+			modify: func(m *Manifest) {
+				m.InvocationImages["cnab"].Builder = ""
+				m.InvocationImages["another"] = &InvocationImage{Builder: "docker"}
+			},
+			fields: []string{"invocationImages[another].name", "invocationImages[cnab].builder"},
+		},
+		{
+			name: "invalid images, parameters and credentials",
+			modify: func(m *Manifest) {
+				m.Images["istio"] = bundle.Image{Description: "istio images"}
+				m.Parameters["foo"] = bundle.ParameterDefinition{DataType: "int", DefaultValue: "bar"}
+				m.Parameters["unknown"] = bundle.ParameterDefinition{DataType: "float"}
+				m.Credentials["kubeconfig"] = bundle.Location{}
+			},
+			fields: []string{
+				"images[istio].image",
+				"parameters[foo].defaultValue",
+				"parameters[unknown].type",
+				"credentials[kubeconfig]",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			is := assert.New(t)
+			m := validManifest()
+			tc.modify(m)
+
+			err := m.Validate()
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("expected a *ValidationError, got %v", err)
+			}
+			var fields []string
+			for _, fe := range verr.Errors {
+				fields = append(fields, fe.Field)
+			}
+			is.Equal(tc.fields, fields)
+
+			var fe *FieldError
+			is.True(errors.As(err, &fe))
+			is.Equal(tc.fields[0], fe.Field)
+		})
+	}
+}
+
+func TestValidationError_Error(t *testing.T) {
+	m := validManifest()
+	m.Name = ""
+	m.InvocationImages["cnab"].Builder = ""
+	assert.EqualError(t, m.Validate(), "invalid manifest: name: is required; invocationImages[cnab].builder: is required")
+}